@@ -64,6 +64,25 @@ func ReadFileNames(file fs.OsFile) ([]string, error) {
 	return list, nil
 }
 
+// ReadDirSize returns the total size in bytes and the number of the regular
+// files that are direct children of the given directory.
+func ReadDirSize(file fs.OsFile) (int64, int64, error) {
+	files, err := ioutil.ReadDir(file.Path())
+	if err != nil {
+		return 0, 0, err
+	}
+	size := int64(0)
+	count := int64(0)
+	for _, f := range files {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		size += f.Size()
+		count++
+	}
+	return size, count, nil
+}
+
 func GetExecPath() (string, error) {
 	ex, err := os.Executable()
 	if err != nil {
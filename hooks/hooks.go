@@ -0,0 +1,205 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+// Package hooks Defines the events of the server that custom builds of it can
+// react to.
+//
+// The server is a main package, so it can't be imported and embedded. The
+// hooks are registered by adding a file to the server package that registers
+// them from an init function, before the server starts listening, and building
+// the server with it:
+//
+//	func init() {
+//		hooks.Register(indexer{})
+//	}
+//
+// Pre-hooks are the ones returning an error. If a pre-hook returns an error,
+// the operation is not done, and the error message is sent to the client.
+package hooks
+
+import (
+	"sync"
+)
+
+// Client Identifies the client that caused the event. User is set instead of
+// the CID when the event was not caused by a client, like "admin-api".
+type Client struct {
+	CID     uint
+	User    string
+	Address string
+	Channel string // Channel the client is subscribed to
+}
+
+// File Identifies the file of a transfer.
+type File struct {
+	Channel string
+	Path    string // Path of the file relative to its channel
+	Size    uint64
+}
+
+// Hooks Callbacks for the events of the server. They're called from the
+// goroutine of the client, so a slow hook delays that client.
+type Hooks interface {
+	// OnConnect Pre-hook called when a client connects, before it's registered,
+	// so a client rejected never receives any update.
+	OnConnect(c Client) error
+
+	OnDisconnect(c Client)
+
+	// OnUploadStarted Pre-hook called before the file is written.
+	OnUploadStarted(c Client, f File) error
+
+	OnUploadCompleted(c Client, f File)
+
+	// OnDownloadStarted Pre-hook called before the file is read.
+	OnDownloadStarted(c Client, f File) error
+
+	OnDownloadCompleted(c Client, f File)
+
+	// OnFileDeleting Pre-hook called before the file is deleted.
+	OnFileDeleting(c Client, f File) error
+
+	OnFileDeleted(c Client, f File)
+
+	// OnChannelCreating Pre-hook called before the channel is created.
+	OnChannelCreating(c Client, channel string) error
+
+	OnChannelCreated(c Client, channel string)
+
+	// OnChannelDeleting Pre-hook called before the channel is deleted.
+	OnChannelDeleting(c Client, channel string) error
+
+	OnChannelDeleted(c Client, channel string)
+}
+
+// Base Implements every hook doing nothing, so it can be embedded to implement
+// only the required hooks.
+type Base struct{}
+
+func (Base) OnConnect(Client) error                 { return nil }
+func (Base) OnDisconnect(Client)                    {}
+func (Base) OnUploadStarted(Client, File) error     { return nil }
+func (Base) OnUploadCompleted(Client, File)         {}
+func (Base) OnDownloadStarted(Client, File) error   { return nil }
+func (Base) OnDownloadCompleted(Client, File)       {}
+func (Base) OnFileDeleting(Client, File) error      { return nil }
+func (Base) OnFileDeleted(Client, File)             {}
+func (Base) OnChannelCreating(Client, string) error { return nil }
+func (Base) OnChannelCreated(Client, string)        {}
+func (Base) OnChannelDeleting(Client, string) error { return nil }
+func (Base) OnChannelDeleted(Client, string)        {}
+
+var (
+	mu         sync.Mutex
+	registered Chain
+)
+
+// Register Adds the hooks to be called by the server. It must be called before
+// the server starts.
+func Register(h Hooks) {
+	mu.Lock()
+	defer mu.Unlock()
+	registered = append(registered, h)
+}
+
+// Registered Returns all the hooks registered, in order.
+func Registered() Chain {
+	mu.Lock()
+	defer mu.Unlock()
+	return append(Chain{}, registered...)
+}
+
+// Chain Calls a list of hooks in order. A pre-hook error stops the chain and
+// vetoes the operation.
+type Chain []Hooks
+
+func (c Chain) OnConnect(client Client) error {
+	for _, h := range c {
+		if err := h.OnConnect(client); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c Chain) OnDisconnect(client Client) {
+	for _, h := range c {
+		h.OnDisconnect(client)
+	}
+}
+
+func (c Chain) OnUploadStarted(client Client, f File) error {
+	for _, h := range c {
+		if err := h.OnUploadStarted(client, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c Chain) OnUploadCompleted(client Client, f File) {
+	for _, h := range c {
+		h.OnUploadCompleted(client, f)
+	}
+}
+
+func (c Chain) OnDownloadStarted(client Client, f File) error {
+	for _, h := range c {
+		if err := h.OnDownloadStarted(client, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c Chain) OnDownloadCompleted(client Client, f File) {
+	for _, h := range c {
+		h.OnDownloadCompleted(client, f)
+	}
+}
+
+func (c Chain) OnFileDeleting(client Client, f File) error {
+	for _, h := range c {
+		if err := h.OnFileDeleting(client, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c Chain) OnFileDeleted(client Client, f File) {
+	for _, h := range c {
+		h.OnFileDeleted(client, f)
+	}
+}
+
+func (c Chain) OnChannelCreating(client Client, channel string) error {
+	for _, h := range c {
+		if err := h.OnChannelCreating(client, channel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c Chain) OnChannelCreated(client Client, channel string) {
+	for _, h := range c {
+		h.OnChannelCreated(client, channel)
+	}
+}
+
+func (c Chain) OnChannelDeleting(client Client, channel string) error {
+	for _, h := range c {
+		if err := h.OnChannelDeleting(client, channel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c Chain) OnChannelDeleted(client Client, channel string) {
+	for _, h := range c {
+		h.OnChannelDeleted(client, channel)
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package hooks
+
+import (
+	"errors"
+	"testing"
+)
+
+type recorder struct {
+	Base
+	uploads []string
+	veto    error
+}
+
+func (r *recorder) OnUploadStarted(_ Client, f File) error {
+	r.uploads = append(r.uploads, f.Path)
+	return r.veto
+}
+
+func TestChain(t *testing.T) {
+	first := &recorder{}
+	second := &recorder{veto: errors.New("file type not allowed")}
+	third := &recorder{}
+	chain := Chain{first, second, third}
+	f := File{Channel: "test", Path: "file.exe"}
+
+	err := chain.OnUploadStarted(Client{CID: 1}, f)
+	if err == nil || err.Error() != "file type not allowed" {
+		t.Fatal("Pre-hook veto not returned:", err)
+	}
+	if len(first.uploads) != 1 || len(second.uploads) != 1 {
+		t.Fatal("Hooks before the veto must be called")
+	}
+	if len(third.uploads) != 0 {
+		t.Fatal("Hooks after the veto must not be called")
+	}
+	if err := (Chain{}).OnConnect(Client{}); err != nil {
+		t.Fatal("Empty chain must not veto:", err)
+	}
+}
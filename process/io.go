@@ -12,6 +12,11 @@ type StartPayload struct {
 	Action
 	fs.FileInfo
 	Channel Channel
+	Version uint // Version of the file to download, the current one if 0
+
+	// Metadata and tags added to the file uploaded
+	Metadata map[string]string
+	Tags     []string
 }
 
 type StreamPayload struct {
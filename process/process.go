@@ -7,6 +7,7 @@ package process
 import (
 	"errors"
 	"fs"
+	"strings"
 )
 
 var Valid = struct{}{}
@@ -65,11 +66,11 @@ type Process struct {
 	user   User
 }
 
-func NewProcess(osFsRoot string) Process {
+func NewProcess(osFsRoot string, quotas Quotas, versions Versions) Process {
 	return Process{
 		state:  Start,
 		action: 0,
-		user:   newUser(osFsRoot),
+		user:   newUser(osFsRoot, quotas, versions),
 	}
 }
 
@@ -89,8 +90,13 @@ func (p *Process) Start(payload StartPayload) error {
 	if !(p.state == Start || p.state == Done || p.state == Error) {
 		return errors.New("invalid state: " + string(p.state))
 	}
-	p.action = payload.Action
-	err := p.user.start(payload)
+	action, err := ToAction(uint(payload.Action))
+	if err != nil {
+		p.Error()
+		return err
+	}
+	p.action = action
+	err = p.user.start(payload)
 	if err != nil {
 		p.Error()
 		return err
@@ -136,9 +142,16 @@ func (p *Process) Done() error {
 }
 
 func (p *Process) Error() {
+	p.Release()
 	p.state = Error
 }
 
+// Release Returns the quota reserved for the rest of the upload in progress,
+// e.g. when the client disconnects in the middle of it.
+func (p *Process) Release() {
+	p.user.release()
+}
+
 func (p *Process) onStarted() {
 	switch p.action {
 	case ActionUpload:
@@ -160,6 +173,11 @@ func NewChannel(name string) Channel {
 	return Channel{Name: name}
 }
 
+// File Returns the directory of the channel in the FS. The names starting with
+// a dot are reserved for the server, like the metadata of the channels.
 func (c Channel) File() (fs.File, error) {
+	if strings.HasPrefix(c.Name, ".") {
+		return fs.File{}, errors.New("invalid channel name, it starts with a dot")
+	}
 	return fs.NewFileFromString(c.Name)
 }
@@ -0,0 +1,39 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package process
+
+// Quota Defines the storage limits of a channel. A zero limit means unlimited.
+type Quota struct {
+	MaxBytes uint64
+	MaxFiles uint64
+}
+
+// Usage Defines the storage currently used by a channel.
+type Usage struct {
+	Bytes uint64
+	Files uint64
+}
+
+// Quotas Keeps the storage accounting of the channels, so that uploads can be
+// checked against the quota of their channel.
+type Quotas interface {
+	// Reserve records the given number of bytes and files into the channel
+	// usage, or returns an error if they exceed its quota. The check and the
+	// record are done at once, so concurrent uploads can't overshoot the quota.
+	Reserve(channel Channel, bytes int64, files int64) error
+
+	// Add records the given number of bytes and files into the channel usage.
+	// Negative values are used when content is removed.
+	Add(channel Channel, bytes int64, files int64)
+}
+
+// Unlimited Quotas that never reject anything.
+type Unlimited struct{}
+
+func (Unlimited) Reserve(Channel, int64, int64) error {
+	return nil
+}
+
+func (Unlimited) Add(Channel, int64, int64) {}
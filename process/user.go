@@ -9,6 +9,7 @@ import (
 	"fs"
 	"fs/files"
 	"log"
+	"os"
 )
 
 // User Contains all the FSM implementation details.
@@ -17,11 +18,17 @@ type User struct {
 	file     fs.OsFile
 	osFsRoot string
 	count    int64
+	quotas   Quotas
+	versions Versions
+	replaced bool  // Whether the upload replaces an existing file
+	reserved int64 // Bytes of the quota reserved for the upload, not written yet
 }
 
-func newUser(osFsRoot string) User {
+func newUser(osFsRoot string, quotas Quotas, versions Versions) User {
 	return User{
 		osFsRoot: osFsRoot,
+		quotas:   quotas,
+		versions: versions,
 	}
 }
 
@@ -37,6 +44,11 @@ func (u User) Channel() Channel {
 	return u.req.channel
 }
 
+// Replaced Returns true iff the file uploaded already existed.
+func (u User) Replaced() bool {
+	return u.replaced
+}
+
 func (u *User) start(payload StartPayload) error {
 	u.req.set(payload)
 	u.count = 0
@@ -64,7 +76,7 @@ func (u *User) setFile() error {
 	return nil
 }
 
-func (u User) startAction(payload StartPayload) error {
+func (u *User) startAction(payload StartPayload) error {
 	switch payload.Action {
 	case ActionUpload:
 		err := u.startActionUpload()
@@ -72,7 +84,7 @@ func (u User) startAction(payload StartPayload) error {
 			return err
 		}
 	case ActionDownload:
-		err := u.startActionDownload()
+		err := u.startActionDownload(payload.Version)
 		if err != nil {
 			return err
 		}
@@ -80,19 +92,76 @@ func (u User) startAction(payload StartPayload) error {
 	return nil
 }
 
-func (u User) startActionUpload() error {
+func (u *User) startActionUpload() error {
 	if u.req.info.Size <= 0 {
 		return errors.New("file sent is empty")
 	}
-	err := u.createFile()
+	prevSize, newFiles, err := u.readReplacedFile()
 	if err != nil {
 		log.Println(err)
+		return errors.New("fail to read file size")
+	}
+	channel := u.req.channel
+	size := int64(u.req.info.Size)
+	err = u.quotas.Reserve(channel, size-prevSize, newFiles)
+	if err != nil {
+		return err
+	}
+	if newFiles == 0 {
+		err = u.versions.Keep(channel, u.req.info.Value, u.file)
+		if err != nil {
+			log.Println(err)
+			u.quotas.Add(channel, prevSize-size, -newFiles)
+			return errors.New("fail to keep file version")
+		}
+	}
+	err = u.createFile()
+	if err != nil {
+		log.Println(err)
+		u.quotas.Add(channel, prevSize-size, -newFiles)
+		// The replaced file is gone if it was moved or removed before failing
+		if exists, _ := files.Exists(u.file); newFiles == 0 && !exists {
+			u.quotas.Add(channel, -prevSize, -1)
+		}
 		return errors.New("fail to create file")
 	}
+	u.reserved = size
+	u.replaced = newFiles == 0
 	return nil
 }
 
-func (u User) startActionDownload() error {
+// Returns the quota reserved for the part of the upload that was not written,
+// when the upload is not going to be completed.
+func (u *User) release() {
+	if u.reserved <= 0 {
+		return
+	}
+	u.quotas.Add(u.req.channel, -u.reserved, 0)
+	u.reserved = 0
+}
+
+// Returns the size of the file that is going to be replaced by the upload, and
+// the number of files that the upload adds to the channel.
+func (u User) readReplacedFile() (int64, int64, error) {
+	exists, err := files.Exists(u.file)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !exists {
+		return 0, 1, nil
+	}
+	size, err := files.ReadSize(u.file)
+	return size, 0, err
+}
+
+func (u *User) startActionDownload(version uint) error {
+	if version > 0 {
+		file, err := u.versions.File(u.req.channel, u.req.info.Value, version)
+		if err != nil {
+			return err
+		}
+		u.file = file
+	}
 	exists, err := files.Exists(u.file)
 	if err != nil {
 		log.Println(err)
@@ -126,7 +195,13 @@ func (u User) createChannelIfNotExists() error {
 	return nil
 }
 
+// Creates the file uploaded, unlinking the previous one first, since its
+// content may be shared with other paths, like when it's a link to a blob.
 func (u User) createFile() error {
+	err := os.Remove(u.file.Path())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
 	return files.Create(u.file)
 }
 
@@ -137,12 +212,14 @@ func (u *User) processChunk(chunk []byte) error {
 	if len(chunk) == 0 {
 		return errors.New("underflow")
 	}
+	size := int64(len(chunk))
 	err := files.WriteBuf(u.file, chunk)
 	if err != nil {
 		log.Println(err)
 		return errors.New("fail to write chunk")
 	}
-	u.count += int64(len(chunk))
+	u.reserved -= size
+	u.count += size
 	return nil
 }
 
@@ -0,0 +1,32 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package process
+
+import (
+	"errors"
+	"fs"
+)
+
+// Versions Keeps the previous content of the files replaced by uploads, so
+// they can be downloaded or restored later.
+type Versions interface {
+	// Keep moves the content of the file about to be replaced by an upload
+	// into a new version of it.
+	Keep(channel Channel, path string, file fs.OsFile) error
+
+	// File returns the file with the content of the given version.
+	File(channel Channel, path string, version uint) (fs.OsFile, error)
+}
+
+// NoVersions Versions that keep nothing, so the replaced content is lost.
+type NoVersions struct{}
+
+func (NoVersions) Keep(Channel, string, fs.OsFile) error {
+	return nil
+}
+
+func (NoVersions) File(Channel, string, uint) (fs.OsFile, error) {
+	return fs.OsFile{}, errors.New("file versions are disabled")
+}
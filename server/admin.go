@@ -0,0 +1,265 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fs/files"
+	"fs/hooks"
+	"fs/process"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	apiClients   = "/api/clients"
+	apiChannels  = "/api/channels"
+	apiTransfers = "/api/transfers"
+
+	defaultKickReason = "disconnected by an admin"
+
+	// Actor of the changes done through the API, as they're not done by a
+	// client and can't be attributed to a CID.
+	adminApiUser = "admin-api"
+)
+
+var (
+	errMethodNotAllowed = errors.New("method not allowed")
+	errInvalidCid       = errors.New("invalid CID")
+	errInvalidChannel   = errors.New("invalid channel")
+	errServer           = errors.New("server error")
+)
+
+// ClientInfo Describes a connected client and what it's doing. The action and
+// file are set while the client has a transfer in progress.
+type ClientInfo struct {
+	CID           uint
+	Address       string
+	Channel       string
+	State         process.State
+	Action        string
+	File          string
+	Bytes         uint64 // Bytes moved since the client connected
+	Connected     time.Time
+	LastActivity  time.Time
+	Admin         bool
+	Profile       Profile
+	Subscriptions []string
+}
+
+type ChannelInfo struct {
+	Name  string
+	Bytes uint64
+	Files uint64
+}
+
+// adminApi Serves the admin HTTP/JSON API with the live data of the Hub. Every
+// request requires the admin token as a bearer token.
+//
+// GET    /api/clients
+// DELETE /api/clients/{cid}?reason={reason}
+// GET    /api/channels
+// DELETE /api/channels/{name}
+// GET    /api/transfers
+type adminApi struct {
+	svc *services
+	hub *Hub
+	log logger
+}
+
+// Starts the HTTP server of the admin API. It does nothing if the address is
+// empty, and it refuses to start without an admin token.
+func serveAdminApi(addr string, svc *services, hub *Hub) {
+	if addr == "" {
+		return
+	}
+	log := svc.log.with("api", "admin")
+	if svc.cfg.adminToken == "" {
+		log.error("Admin API requires an admin token, not starting it")
+		return
+	}
+	api := adminApi{svc: svc, hub: hub, log: log}
+	mux := http.NewServeMux()
+	mux.HandleFunc(apiClients, api.handle(api.clients))
+	mux.HandleFunc(apiClients+"/", api.handle(api.client))
+	mux.HandleFunc(apiChannels, api.handle(api.channels))
+	mux.HandleFunc(apiChannels+"/", api.handle(api.channel))
+	mux.HandleFunc(apiTransfers, api.handle(api.transfers))
+	go func() {
+		log.info("Serving admin API", "addr", addr)
+		err := http.ListenAndServe(addr, mux)
+		log.error("Admin API stopped", "err", err)
+	}()
+}
+
+type apiHandler func(r *http.Request) (any, int, error)
+
+// Wraps the handler with the CORS headers for the dashboard, the admin
+// authentication, and the JSON encoding of its result.
+func (a adminApi) handle(h apiHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, DELETE")
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if !a.isAuthorized(r) {
+			writeJson(w, http.StatusUnauthorized, ErrorPayload{Message: "unauthorized"})
+			return
+		}
+		result, code, err := h(r)
+		if err != nil {
+			a.log.warn("Admin request failed", "path", r.URL.Path, "err", err)
+			writeJson(w, code, ErrorPayload{Message: err.Error()})
+			return
+		}
+		a.log.debug("Admin request", "method", r.Method, "path", r.URL.Path)
+		writeJson(w, code, result)
+	}
+}
+
+func (a adminApi) isAuthorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	expected := a.svc.cfg.adminToken
+	return subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+func (a adminApi) clients(r *http.Request) (any, int, error) {
+	if r.Method != http.MethodGet {
+		return nil, http.StatusMethodNotAllowed, errMethodNotAllowed
+	}
+	list := make([]ClientInfo, 0)
+	for _, client := range a.hub.requestClients() {
+		list = append(list, client.info())
+	}
+	return list, http.StatusOK, nil
+}
+
+func (a adminApi) client(r *http.Request) (any, int, error) {
+	if r.Method != http.MethodDelete {
+		return nil, http.StatusMethodNotAllowed, errMethodNotAllowed
+	}
+	value := strings.TrimPrefix(r.URL.Path, apiClients+"/")
+	cid, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return nil, http.StatusBadRequest, errInvalidCid
+	}
+	reason := r.URL.Query().Get("reason")
+	if reason == "" {
+		reason = defaultKickReason
+	}
+	err = a.hub.requestKick(uint(cid), reason)
+	a.audit(r, AuditEntry{Action: AuditKick, Target: value}, err)
+	if err != nil {
+		return nil, http.StatusNotFound, err
+	}
+	return QuitPayload{Reason: reason}, http.StatusOK, nil
+}
+
+func (a adminApi) channels(r *http.Request) (any, int, error) {
+	if r.Method != http.MethodGet {
+		return nil, http.StatusMethodNotAllowed, errMethodNotAllowed
+	}
+	list, err := readChannelInfos()
+	if err != nil {
+		a.log.error("Fail to read channels", "err", err)
+		return nil, http.StatusInternalServerError, errServer
+	}
+	return list, http.StatusOK, nil
+}
+
+func (a adminApi) channel(r *http.Request) (any, int, error) {
+	if r.Method != http.MethodDelete {
+		return nil, http.StatusMethodNotAllowed, errMethodNotAllowed
+	}
+	name := strings.TrimPrefix(r.URL.Path, apiChannels+"/")
+	channel := process.NewChannel(name)
+	if _, err := channel.File(); err != nil || name == "" {
+		return nil, http.StatusBadRequest, errInvalidChannel
+	}
+	by := hooks.Client{User: adminApiUser, Address: r.RemoteAddr}
+	err := removeChannel(a.svc, a.log, channel, by)
+	a.audit(r, AuditEntry{Action: AuditDeleteChannel, Channel: name}, err)
+	if errors.As(err, &vetoError{}) {
+		return nil, http.StatusForbidden, err
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	a.svc.hooks.OnChannelDeleted(by, name)
+	u := newChange(ChangeChannelDeleted, name, "", 0)
+	u.User = adminApiUser
+	a.hub.change <- u
+	return ChannelInfo{Name: name}, http.StatusOK, nil
+}
+
+func (a adminApi) transfers(r *http.Request) (any, int, error) {
+	if r.Method != http.MethodGet {
+		return nil, http.StatusMethodNotAllowed, errMethodNotAllowed
+	}
+	return readTransfers(a.hub.requestClients()), http.StatusOK, nil
+}
+
+// Records the operation done through the API into the audit log.
+func (a adminApi) audit(r *http.Request, e AuditEntry, err error) {
+	e.Time = time.Now()
+	e.User = adminApiUser
+	e.Address = r.RemoteAddr
+	e.Outcome, e.Error = auditOutcome(err)
+	if err := a.svc.audit.record(e); err != nil {
+		a.log.error("Fail to write audit entry", "err", err)
+	}
+}
+
+// Returns the transfers in progress of the clients.
+func readTransfers(clients []*Client) []TransferInfo {
+	list := make([]TransferInfo, 0)
+	for _, client := range clients {
+		if info, ok := client.transfer(); ok {
+			list = append(list, info)
+		}
+	}
+	return list
+}
+
+func readChannelInfos() ([]ChannelInfo, error) {
+	root, err := getFsRootFile()
+	if err != nil {
+		return nil, err
+	}
+	channels, err := readChannels()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]ChannelInfo, 0, len(channels))
+	for _, name := range channels {
+		dir, err := process.NewChannel(name).File()
+		if err != nil {
+			continue
+		}
+		size, count, err := files.ReadDirSize(dir.ToOsFile(root.Path()))
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, ChannelInfo{
+			Name:  name,
+			Bytes: uint64(size),
+			Files: uint64(count),
+		})
+	}
+	return list, nil
+}
+
+func writeJson(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
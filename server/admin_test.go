@@ -0,0 +1,93 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fs"
+	"fs/hooks"
+	"fs/utils"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAdminApiClients(t *testing.T) {
+	audit, err := openAuditLog(t.TempDir())
+	utils.RequirePassCase(t, err, "Fail to open audit log")
+	svc := &services{cfg: config{adminToken: "secret"}, audit: audit}
+	hub := NewHub(logger{}, newMetrics(), nil)
+	go hub.run()
+	defer func() { hub.quit <- struct{}{} }()
+	api := adminApi{svc: svc, hub: hub}
+
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, apiClients, nil)
+	api.handle(api.clients)(res, req)
+	if res.Code != http.StatusUnauthorized {
+		t.Fatal("Request without token must be unauthorized")
+	}
+
+	res = httptest.NewRecorder()
+	req.Header.Set("Authorization", "Bearer secret")
+	api.handle(api.clients)(res, req)
+	var clients []ClientInfo
+	err = json.NewDecoder(res.Body).Decode(&clients)
+	utils.RequirePassCase(t, err, "Fail to read clients")
+	if res.Code != http.StatusOK || len(clients) != 0 {
+		t.Fatal("Wrong list of clients:", res.Code, clients)
+	}
+
+	res = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodDelete, apiClients+"/7", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	api.handle(api.client)(res, req)
+	if res.Code != http.StatusNotFound {
+		t.Fatal("Kicking an unknown client must fail:", res.Code)
+	}
+}
+
+type channelGuard struct {
+	hooks.Base
+}
+
+func (channelGuard) OnChannelDeleting(c hooks.Client, channel string) error {
+	if c.User != adminApiUser {
+		return errors.New("deletion not attributed to the admin API")
+	}
+	if channel == "main" {
+		return errors.New("channel main can't be deleted")
+	}
+	return nil
+}
+
+func TestAdminApiChannelVetoed(t *testing.T) {
+	audit, err := openAuditLog(t.TempDir())
+	utils.RequirePassCase(t, err, "Fail to open audit log")
+	root := t.TempDir()
+	utils.RequirePassCase(t, os.Mkdir(root+fs.Separator+"main", os.ModePerm), "Fail to create channel")
+	svc := &services{
+		cfg:      config{adminToken: "secret"},
+		audit:    audit,
+		osFsRoot: root,
+		hooks:    hooks.Chain{channelGuard{}},
+	}
+	api := adminApi{svc: svc, log: logger{}}
+
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodDelete, apiChannels+"/main", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	api.handle(api.channel)(res, req)
+	if res.Code != http.StatusForbidden ||
+		!strings.Contains(res.Body.String(), "main can't be deleted") {
+		t.Fatal("Deleting a channel vetoed by a hook must be forbidden:", res.Code)
+	}
+	if _, err = os.Stat(root + fs.Separator + "main"); err != nil {
+		t.Fatal("Channel vetoed must not be deleted")
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const rejectWriteTimeOut = 2 * time.Second
+
+// admission Decides which of the accepted connections become clients of the
+// server, according to the max number of clients, the max number of clients
+// for each IP, and the rate of new connections.
+type admission struct {
+	mu         sync.Mutex
+	maxClients int // Zero means unlimited
+	maxPerIp   int // Zero means unlimited
+	clients    int
+	ips        map[string]int
+	rate       *tokenBucket // New connections per second
+}
+
+func newAdmission(cfg config) *admission {
+	return &admission{
+		maxClients: cfg.maxClients,
+		maxPerIp:   cfg.maxClientsPerIp,
+		clients:    0,
+		ips:        make(map[string]int),
+		rate:       newTokenBucketWithBurst(cfg.acceptRate, 1),
+	}
+}
+
+// Reserves a place for the connection, or returns the reason why it's rejected.
+// An admitted connection must be released when it ends.
+func (a *admission) admit(conn net.Conn) error {
+	ip := remoteIp(conn)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.maxClients > 0 && a.clients >= a.maxClients {
+		return errors.New("server is full, try again later")
+	}
+	if a.maxPerIp > 0 && a.ips[ip] >= a.maxPerIp {
+		return errors.New("too many connections from this address")
+	}
+	if !a.rate.take(1) {
+		return errors.New("too many new connections, try again later")
+	}
+	a.clients++
+	a.ips[ip]++
+	return nil
+}
+
+func (a *admission) release(conn net.Conn) {
+	ip := remoteIp(conn)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.clients--
+	a.ips[ip]--
+	if a.ips[ip] <= 0 {
+		delete(a.ips, ip)
+	}
+}
+
+// Sends the rejection message to the connection and closes it.
+func reject(conn net.Conn, reason string) {
+	defer conn.Close()
+	// Don't let a client that doesn't read hold its goroutine
+	_ = conn.SetWriteDeadline(time.Now().Add(rejectWriteTimeOut))
+	_ = writeErrorState(reason, conn)
+}
+
+func remoteIp(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
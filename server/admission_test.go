@@ -0,0 +1,89 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fs/hooks"
+	"fs/process"
+	"fs/utils"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAdmission(t *testing.T) {
+	a := newAdmission(config{maxClients: 2, maxClientsPerIp: 1})
+	first, _ := net.Pipe()
+	second, _ := net.Pipe()
+
+	err := a.admit(first)
+	utils.RequirePassCase(t, err, "First connection must be admitted")
+	err = a.admit(second)
+	utils.RequireFailureCase(t, err, "Connection over the IP limit must fail")
+
+	a.release(first)
+	err = a.admit(second)
+	utils.RequirePassCase(t, err, "Released place must be available again")
+}
+
+func TestReject(t *testing.T) {
+	server, client := net.Pipe()
+	go reject(server, "server is full")
+
+	var msg Message
+	err := json.NewDecoder(client).Decode(&msg)
+	utils.RequirePassCase(t, err, "Fail to read rejection message")
+	if msg.State != process.Error {
+		t.Fatal("Rejection must be an ERROR message")
+	}
+	payload, _ := msg.ErrorPayload()
+	if payload.Message != "server is full" {
+		t.Fatal("Wrong rejection reason:", payload.Message)
+	}
+}
+
+type connectGuard struct {
+	hooks.Base
+}
+
+func (connectGuard) OnConnect(hooks.Client) error {
+	return errors.New("banned")
+}
+
+func TestClientRejectedByHook(t *testing.T) {
+	svc := &services{
+		admission: newAdmission(config{}),
+		throttle:  newThrottle(config{}),
+		hooks:     hooks.Chain{connectGuard{}},
+	}
+	hub := NewHub(logger{}, nil, nil)
+	server, client := net.Pipe()
+	c := newClient(
+		server, svc, hub.register, hub.unregister, hub.change, hub.list,
+		hub.clientHubChange, hub.inspect, hub.kick, hub.setGlobal, hub.presence,
+		hub.chat, hub.subscription, hub.watch, hub.observe, hub.activity,
+	)
+	done := make(chan struct{})
+	go func() {
+		// The Hub is not running, so registering the client would block
+		c.run()
+		close(done)
+	}()
+
+	var msg Message
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	err := json.NewDecoder(client).Decode(&msg)
+	utils.RequirePassCase(t, err, "Client must be rejected before it's registered")
+	if payload, _ := msg.ErrorPayload(); payload.Message != "banned" {
+		t.Fatal("Wrong rejection reason:", payload.Message)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Client rejected by a hook must not be registered")
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fs"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	auditFile         = "audit.log"
+	auditDefaultLimit = 100
+	auditMaxLimit     = 1000
+)
+
+type AuditAction string
+
+const (
+	AuditUpload         AuditAction = "UPLOAD"
+	AuditDownload       AuditAction = "DOWNLOAD"
+	AuditCreateChannel  AuditAction = "CREATE_CHANNEL"
+	AuditDeleteChannel  AuditAction = "DELETE_CHANNEL"
+	AuditDeleteFile     AuditAction = "DELETE_FILE"
+	AuditListFiles      AuditAction = "LIST_FILES"
+	AuditKick           AuditAction = "KICK"
+	AuditAbortTransfer  AuditAction = "ABORT_TRANSFER"
+	AuditRestoreVersion AuditAction = "RESTORE_VERSION"
+	AuditRestoreTrash   AuditAction = "RESTORE_TRASH"
+	AuditEmptyTrash     AuditAction = "EMPTY_TRASH"
+)
+
+type AuditOutcome string
+
+const (
+	AuditSuccess AuditOutcome = "SUCCESS"
+	AuditFailure AuditOutcome = "FAILURE"
+)
+
+// AuditEntry Records who did an operation on the file system, when, and what
+// was the outcome.
+type AuditEntry struct {
+	Time    time.Time
+	CID     uint
+	User    string // Who the client is, if known, e.g. "admin"
+	Address string
+	Action  AuditAction
+	Target  string `json:",omitempty"` // ID of the client or transfer acted on
+	Channel string
+	File    string
+	Size    uint64
+	Outcome AuditOutcome
+	Error   string `json:",omitempty"`
+}
+
+// AuditFilter Selects the entries of the audit log. The zero values don't
+// filter anything.
+type AuditFilter struct {
+	From    time.Time
+	To      time.Time
+	Channel string
+	CID     *uint
+	Limit   int // Max number of the most recent entries
+}
+
+func (f AuditFilter) matches(e AuditEntry) bool {
+	if !f.From.IsZero() && e.Time.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && e.Time.After(f.To) {
+		return false
+	}
+	if f.Channel != "" && e.Channel != f.Channel {
+		return false
+	}
+	if f.CID != nil && e.CID != *f.CID {
+		return false
+	}
+	return true
+}
+
+// auditLog Writes the audit entries into an append-only JSON-lines file.
+type auditLog struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+func openAuditLog(osDataRoot string) (*auditLog, error) {
+	path := osDataRoot + fs.Separator + auditFile
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{path: path, file: f}, nil
+}
+
+func (a *auditLog) record(e AuditEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err = a.file.Write(append(line, '\n'))
+	return err
+}
+
+// Returns the most recent entries that match the filter, oldest first.
+func (a *auditLog) query(filter AuditFilter) ([]AuditEntry, error) {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = auditDefaultLimit
+	}
+	if limit > auditMaxLimit {
+		limit = auditMaxLimit
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f, err := os.Open(a.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries := make([]AuditEntry, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue // Skip a line that was partially written
+		}
+		if !filter.matches(e) {
+			continue
+		}
+		entries = append(entries, e)
+		if len(entries) >= 2*limit {
+			entries = append(entries[:0], entries[len(entries)-limit:]...)
+		}
+	}
+	if len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	return entries, scanner.Err()
+}
+
+// Returns the outcome and the error message of an audited operation.
+func auditOutcome(err error) (AuditOutcome, string) {
+	if err != nil {
+		return AuditFailure, err.Error()
+	}
+	return AuditSuccess, ""
+}
@@ -0,0 +1,46 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"errors"
+	"fs/utils"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	audit, err := openAuditLog(t.TempDir())
+	utils.RequirePassCase(t, err, "Fail to open audit log")
+	start := time.Now()
+	outcome, msg := auditOutcome(errors.New("file sent is empty"))
+
+	entries := []AuditEntry{
+		{Time: start, CID: 1, Action: AuditUpload, Channel: "main", Outcome: AuditSuccess},
+		{Time: start.Add(time.Minute), CID: 2, Action: AuditUpload, Channel: "test", Outcome: outcome, Error: msg},
+		{Time: start.Add(2 * time.Minute), CID: 1, Action: AuditDeleteChannel, Channel: "test", Outcome: AuditSuccess},
+	}
+	for _, e := range entries {
+		err = audit.record(e)
+		utils.RequirePassCase(t, err, "Fail to record audit entry")
+	}
+
+	result, err := audit.query(AuditFilter{Channel: "test"})
+	utils.RequirePassCase(t, err, "Fail to query audit log")
+	if len(result) != 2 || result[0].Error != "file sent is empty" {
+		t.Fatal("Wrong entries by channel:", result)
+	}
+
+	cid := uint(1)
+	result, _ = audit.query(AuditFilter{CID: &cid, From: start.Add(time.Second)})
+	if len(result) != 1 || result[0].Action != AuditDeleteChannel {
+		t.Fatal("Wrong entries by CID and time:", result)
+	}
+
+	result, _ = audit.query(AuditFilter{Limit: 1})
+	if len(result) != 1 || result[0].CID != 1 || result[0].Channel != "test" {
+		t.Fatal("Limit must keep the most recent entries:", result)
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fs"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	blobsDir          = "blobs"
+	blobLinkSuffix    = ".link" // Temporary link to a blob, before it's moved
+	blobSweepInterval = 10 * time.Minute
+)
+
+// blobStore Keeps the content of the files uploaded once, keyed by its
+// SHA-256, at blobs/{hash[:2]}/{hash}. The paths of the FS are hard links to
+// their blob, so the link count of a blob is its reference count, and the blobs
+// only linked by the store itself are swept.
+type blobStore struct {
+	mu      sync.Mutex
+	dir     string
+	enabled bool
+	log     logger
+}
+
+// Returns the blob store, which is disabled with a warning if the FS root can't
+// link to the data root, e.g. when they're on different file systems.
+func newBlobStore(
+	osFsRoot string,
+	osDataRoot string,
+	enabled bool,
+	log logger,
+) (*blobStore, error) {
+	b := &blobStore{
+		dir:     osDataRoot + fs.Separator + blobsDir,
+		enabled: enabled,
+		log:     log,
+	}
+	if !enabled {
+		return b, nil
+	}
+	err := os.MkdirAll(b.dir, os.ModePerm)
+	if err != nil {
+		return b, err
+	}
+	err = checkLinks(osFsRoot, b.dir)
+	if err != nil {
+		log.warn(
+			"Deduplication disabled, the FS root and data root must be on the same file system",
+			"err", err,
+		)
+		b.enabled = false
+	}
+	return b, nil
+}
+
+// Sweeps the unreferenced blobs in the background.
+func (b *blobStore) start() {
+	if !b.enabled {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(blobSweepInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			b.sweep()
+		}
+	}()
+}
+
+// Stores the content of the file at the path, and makes the path a link to its
+// blob. If the blob already exists, the content of the path is dropped.
+func (b *blobStore) store(path string) error {
+	if !b.enabled {
+		return nil
+	}
+	sum, err := hashFile(path)
+	if err != nil {
+		return err
+	}
+	blob := b.blobPath(sum)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	err = os.MkdirAll(filepath.Dir(blob), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stat(blob)
+	if errors.Is(err, os.ErrNotExist) {
+		return os.Link(path, blob)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Replace the path at once, so it's never missing for the readers
+	tmp := blob + blobLinkSuffix
+	_ = os.Remove(tmp)
+	err = os.Link(blob, tmp)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return err
+}
+
+// Deletes the blobs that no path of the FS links to anymore, and returns how
+// many were deleted.
+func (b *blobStore) sweep() int {
+	if !b.enabled {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	err := filepath.Walk(b.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || strings.HasSuffix(path, blobLinkSuffix) {
+			return err
+		}
+		links, err := linkCount(path)
+		if err != nil {
+			return err
+		}
+		if links > 1 {
+			return nil
+		}
+		if err = os.Remove(path); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		b.log.error("Fail to sweep blobs", "err", err)
+	}
+	if n > 0 {
+		b.log.info("Blobs swept", "blobs", n)
+	}
+	return n
+}
+
+func (b *blobStore) blobPath(sum string) string {
+	return b.dir + fs.Separator + sum[:2] + fs.Separator + sum
+}
+
+// Returns an error if a file of the FS root can't be hard linked into the
+// directory.
+func checkLinks(osFsRoot string, dir string) error {
+	err := os.MkdirAll(osFsRoot, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(osFsRoot, ".link-check-*")
+	if err != nil {
+		return err
+	}
+	path := f.Name()
+	f.Close()
+	defer os.Remove(path)
+	link := dir + fs.Separator + filepath.Base(path)
+	err = os.Link(path, link)
+	if err != nil {
+		return err
+	}
+	return os.Remove(link)
+}
+
+// Returns the SHA-256 of the content of the file in hex.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
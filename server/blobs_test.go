@@ -0,0 +1,59 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"fs"
+	"fs/utils"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestBlobStore(t *testing.T) {
+	root := t.TempDir()
+	blobs, err := newBlobStore(root, t.TempDir(), true, logger{})
+	utils.RequirePassCase(t, err, "Fail to create blob store")
+	a := root + fs.Separator + "a.txt"
+	b := root + fs.Separator + "b.txt"
+
+	for _, path := range []string{a, b} {
+		utils.RequirePassCase(t, ioutil.WriteFile(path, []byte("same"), 0644), "Fail to write file")
+		utils.RequirePassCase(t, blobs.store(path), "Fail to store blob")
+	}
+	sum, _ := hashFile(a)
+	links, err := linkCount(blobs.blobPath(sum))
+	utils.RequirePassCase(t, err, "Fail to read link count")
+	if links != 3 {
+		t.Fatal("Paths must link to the same blob:", links)
+	}
+	if data, _ := ioutil.ReadFile(b); string(data) != "same" {
+		t.Fatal("Wrong content of the linked path:", string(data))
+	}
+
+	// The blob is kept while a path references it
+	utils.RequirePassCase(t, os.Remove(a), "Fail to delete path")
+	if blobs.sweep() != 0 {
+		t.Fatal("Referenced blob swept")
+	}
+	utils.RequirePassCase(t, os.Remove(b), "Fail to delete path")
+	if blobs.sweep() != 1 {
+		t.Fatal("Unreferenced blob not swept")
+	}
+	if _, err = os.Stat(blobs.blobPath(sum)); !os.IsNotExist(err) {
+		t.Fatal("Blob not deleted")
+	}
+}
+
+func TestBlobStoreWithoutLinks(t *testing.T) {
+	// The FS root is a file, so nothing can be linked from it
+	root := t.TempDir() + fs.Separator + "root"
+	utils.RequirePassCase(t, ioutil.WriteFile(root, nil, 0644), "Fail to write file")
+	blobs, err := newBlobStore(root, t.TempDir(), true, logger{})
+	utils.RequirePassCase(t, err, "Fail to create blob store")
+	if blobs.enabled {
+		t.Fatal("Deduplication must be disabled when links are not supported")
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fs"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+const (
+	chatDir             = "messages"
+	maxChatLength       = 1000
+	chatHistoryDefLimit = 50
+	chatHistoryMaxLimit = 200
+)
+
+// HistoryPayload Sent to the HISTORY command with a page of the messages of a
+// channel, oldest first. More is true if there are older messages.
+type HistoryPayload struct {
+	Channel  string
+	Messages []ChatPayload
+	More     bool
+}
+
+// channelHistory The messages of a channel, persisted as a file.
+type channelHistory struct {
+	Seq      uint64 // ID of the last message
+	Messages []ChatPayload
+}
+
+// chatHistory Keeps the last messages of each channel into the data root, so
+// clients can page through them.
+type chatHistory struct {
+	mu       sync.Mutex
+	dir      string
+	size     int // Max number of messages kept per channel
+	channels map[string]*channelHistory
+}
+
+func loadChatHistory(osDataRoot string, size int) (*chatHistory, error) {
+	dir := osDataRoot + fs.Separator + chatDir
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	return &chatHistory{
+		dir:      dir,
+		size:     size,
+		channels: make(map[string]*channelHistory),
+	}, nil
+}
+
+// Gives the next ID of the channel to the message and keeps it, dropping the
+// oldest message if the history is full.
+func (h *chatHistory) append(msg ChatPayload) (ChatPayload, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	history, err := h.read(msg.Channel)
+	if err != nil {
+		return msg, err
+	}
+	history.Seq++
+	msg.ID = history.Seq
+	history.Messages = append(history.Messages, msg)
+	if len(history.Messages) > h.size {
+		history.Messages = append(
+			history.Messages[:0],
+			history.Messages[len(history.Messages)-h.size:]...,
+		)
+	}
+	data, err := json.Marshal(history)
+	if err != nil {
+		return msg, err
+	}
+	return msg, ioutil.WriteFile(h.path(msg.Channel), data, 0644)
+}
+
+// Returns up to limit messages of the channel with an ID lower than before,
+// or the last ones if before is 0.
+func (h *chatHistory) page(channel string, before uint64, limit int) (HistoryPayload, error) {
+	if limit <= 0 {
+		limit = chatHistoryDefLimit
+	}
+	if limit > chatHistoryMaxLimit {
+		limit = chatHistoryMaxLimit
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	payload := HistoryPayload{Channel: channel, Messages: make([]ChatPayload, 0)}
+	history, err := h.read(channel)
+	if err != nil {
+		return payload, err
+	}
+	end := len(history.Messages)
+	if before > 0 {
+		end = 0
+		for end < len(history.Messages) && history.Messages[end].ID < before {
+			end++
+		}
+	}
+	start := end - limit
+	if start < 0 {
+		start = 0
+	}
+	payload.Messages = append(payload.Messages, history.Messages[start:end]...)
+	payload.More = start > 0
+	return payload, nil
+}
+
+// Deletes the history of the channel.
+func (h *chatHistory) remove(channel string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.channels, channel)
+	err := os.Remove(h.path(channel))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Returns the history of the channel, reading it the first time. It must be
+// called with the lock held.
+func (h *chatHistory) read(channel string) (*channelHistory, error) {
+	if history, ok := h.channels[channel]; ok {
+		return history, nil
+	}
+	history := &channelHistory{Messages: make([]ChatPayload, 0)}
+	data, err := ioutil.ReadFile(h.path(channel))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err = json.Unmarshal(data, history); err != nil {
+			return nil, err
+		}
+	}
+	h.channels[channel] = history
+	return history, nil
+}
+
+func (h *chatHistory) path(channel string) string {
+	return h.dir + fs.Separator + channel + ".json"
+}
+
+// Returns the text of a message without the surrounding spaces, or an error if
+// it's empty or too long.
+func parseChatText(text string) (string, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return "", errors.New("empty TEXT")
+	}
+	if !utf8.ValidString(text) || utf8.RuneCountInString(text) > maxChatLength {
+		return "", errors.New("invalid TEXT")
+	}
+	return text, nil
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"fs/utils"
+	"strings"
+	"testing"
+)
+
+func TestChatHistory(t *testing.T) {
+	dir := t.TempDir()
+	chat, err := loadChatHistory(dir, 3)
+	utils.RequirePassCase(t, err, "Fail to load chat history")
+
+	for i := 0; i < 4; i++ {
+		msg, err := chat.append(ChatPayload{Channel: "test", Text: "hello"})
+		utils.RequirePassCase(t, err, "Fail to append message")
+		if msg.ID != uint64(i+1) {
+			t.Fatal("Wrong message ID:", msg.ID)
+		}
+	}
+	_, _ = chat.append(ChatPayload{Channel: "main", Text: "hello"})
+
+	// Messages 2, 3 and 4 are kept
+	page, err := chat.page("test", 0, 2)
+	utils.RequirePassCase(t, err, "Fail to read history")
+	if len(page.Messages) != 2 || page.Messages[0].ID != 3 || !page.More {
+		t.Fatal("Wrong last page:", page)
+	}
+	page, _ = chat.page("test", 3, 2)
+	if len(page.Messages) != 1 || page.Messages[0].ID != 2 || page.More {
+		t.Fatal("Wrong page before 3:", page)
+	}
+
+	// The history is kept after a restart
+	chat, err = loadChatHistory(dir, 3)
+	utils.RequirePassCase(t, err, "Fail to reload chat history")
+	msg, _ := chat.append(ChatPayload{Channel: "test", Text: "hello"})
+	if msg.ID != 5 {
+		t.Fatal("Chat history not persisted")
+	}
+
+	utils.RequirePassCase(t, chat.remove("test"), "Fail to remove history")
+	page, _ = chat.page("test", 0, 0)
+	if len(page.Messages) != 0 {
+		t.Fatal("History not removed:", page)
+	}
+}
+
+func TestParseChatText(t *testing.T) {
+	if text, err := parseChatText("  hi  "); err != nil || text != "hi" {
+		t.Fatal("Valid text rejected:", text, err)
+	}
+	if _, err := parseChatText(" "); err == nil {
+		t.Fatal("Empty text accepted")
+	}
+	if _, err := parseChatText(strings.Repeat("a", maxChatLength+1)); err == nil {
+		t.Fatal("Long text accepted")
+	}
+}
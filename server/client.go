@@ -6,53 +6,123 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fs/hooks"
 	"fs/process"
-	"log"
 	"net"
+	"sync"
+	"time"
 )
 
+var errConnectionClosed = errors.New("connection closed")
+
 type Client struct {
-	conn            net.Conn
+	conn            net.Conn // Writes through the outbox
+	out             *outbox
+	svc             *services
 	command         command
 	state           state
 	id              uint // Current ID assigned by the Hub
+	throttle        *connThrottle
 	register        chan *Client
 	unregister      chan *Client
-	notify          chan UpdatePayload
+	change          chan UpdatePayload
 	list            chan *Client
-	quit            chan struct{}
+	inspect         chan chan []*Client
+	kicks           chan kickRequest
+	setGlobal       chan globalRequest
+	presence        chan PresencePayload
+	chat            chan ChatPayload
+	subscription    chan subscriptionRequest
+	watch           chan watchRequest
+	watches         map[string]struct{} // Files watched by the client
+	observe         chan observeRequest
+	activity        chan ProgressPayload // Sends progress events to the Hub
+	quit            chan struct{}        // Closed when the client has to end
+	quitOnce        sync.Once
 	clientHubChange chan struct{}
 }
 
 func newClient(
 	conn net.Conn,
-	osFsRoot string,
+	svc *services,
 	register chan *Client,
 	unregister chan *Client,
-	change chan struct{},
+	change chan UpdatePayload,
 	list chan *Client,
 	clientHubChange chan struct{},
+	inspect chan chan []*Client,
+	kicks chan kickRequest,
+	setGlobal chan globalRequest,
+	presence chan PresencePayload,
+	chat chan ChatPayload,
+	subscription chan subscriptionRequest,
+	watch chan watchRequest,
+	observe chan observeRequest,
+	activity chan ProgressPayload,
 ) *Client {
 	client := &Client{
-		conn:            conn,
+		svc:             svc,
+		throttle:        svc.throttle.connect(),
 		register:        register,
 		unregister:      unregister,
 		list:            list,
-		notify:          make(chan UpdatePayload),
+		change:          change,
+		inspect:         inspect,
+		kicks:           kicks,
+		setGlobal:       setGlobal,
+		presence:        presence,
+		chat:            chat,
+		subscription:    subscription,
+		watch:           watch,
+		watches:         make(map[string]struct{}),
+		observe:         observe,
+		activity:        activity,
 		quit:            make(chan struct{}),
 		clientHubChange: clientHubChange,
 	}
-	client.command = newCommand(client.conn, client, clientHubChange, client.quit)
-	client.state = newState(client.conn, osFsRoot, client.sendQuit, change)
+	client.out = newOutbox(conn, outboxSize, client.logger)
+	client.conn = outConn{Conn: conn, out: client.out}
+	client.command = newCommand(
+		client.conn,
+		client,
+		svc,
+		clientHubChange,
+		client.quit,
+	)
+	client.state = newState(
+		client.conn,
+		svc,
+		client.throttle,
+		client.logger,
+		client.audit,
+		client.emitProgress,
+		client.hookClient,
+		client.sendQuit,
+		change,
+	)
 	return client
 }
 
 func (c *Client) run() {
+	go c.out.run()
 	defer c.conn.Close()
+	defer c.svc.admission.release(c.conn)
+	defer c.throttle.release()
+	defer c.state.endTransfer(errConnectionClosed)
+	defer c.state.process.Release()
+	err := c.svc.hooks.OnConnect(c.hookClient())
+	if err != nil {
+		c.logger().info("Client rejected by hook", "reason", err)
+		reject(c.conn, err.Error())
+		return
+	}
 	c.connect() // TODO synchronize, wait for completing signal register
-	log.Println("Client connected")
+	defer func() {
+		c.svc.hooks.OnDisconnect(c.hookClient())
+	}()
+	c.logger().info("Client connected")
 
-	go c.runNotification()
 	for {
 		select {
 		case <-c.quit:
@@ -60,6 +130,9 @@ func (c *Client) run() {
 			return
 		default:
 			c.next()
+			if c.state.isOnHold() {
+				c.out.release()
+			}
 		}
 	}
 }
@@ -68,17 +141,6 @@ func (c *Client) connect() {
 	c.register <- c
 }
 
-func (c *Client) runNotification() {
-	for {
-		select {
-		case u := <-c.notify:
-			c.sendUpdate(u)
-		case <-c.quit:
-			return
-		}
-	}
-}
-
 func (c *Client) next() {
 	if c.state.isInProgress() {
 		c.state.next()
@@ -88,7 +150,7 @@ func (c *Client) next() {
 }
 
 func (c *Client) listenMessage() {
-	log.Println("Listening for client message")
+	c.logger().debug("Listening for client message")
 	msg, err := readMessage(c.conn, longReadTimeOut)
 	if err != nil {
 		c.handleReadError(err, "fail to read message")
@@ -98,9 +160,12 @@ func (c *Client) listenMessage() {
 }
 
 func (c *Client) onMessage(msg Message) {
-	log.Println("Message received with state:", msg.State)
+	c.state.status.touch()
+	c.logger().debug("Message received", "state", msg.State)
 	switch msg.State {
 	case process.Start:
+		// Hold the pushes until the transfer ends
+		c.out.hold()
 		c.state.start(msg)
 	default:
 		c.handleCommand(msg)
@@ -119,28 +184,36 @@ func (c *Client) handleCommand(msg Message) {
 }
 
 func (c *Client) sendUpdate(u UpdatePayload) {
-	if c.state.isInProgress() {
-		return
-	}
-	p, err := NewPayloadFrom(u)
+	c.push(Update, u, priorityNormal)
+}
+
+func (c *Client) sendProgress(p ProgressPayload) {
+	c.push(Progress, p, priorityLow)
+}
+
+func (c *Client) sendPresence(p PresencePayload) {
+	c.push(Presence, p, priorityNormal)
+}
+
+// Queues a message the client didn't request, which is sent once the client
+// has no transfer in progress, so its stream is not corrupted.
+func (c *Client) push(res Response, v any, priority pushPriority) {
+	p, err := NewPayloadFrom(v)
 	if err != nil {
-		log.Println(err)
-		c.state.error("Fail to send update")
+		c.logger().error("Fail to read push payload", "err", err)
 		return
 	}
 	msg := Message{
-		Response: Update,
+		Response: res,
 		Payload:  p,
 	}
-	err = writeMessage(msg, c.conn)
+	err = c.out.push(msg, priority)
 	if err != nil {
-		log.Println(err)
-		c.state.error("Fail to send update")
-		return
+		c.logger().debug("Fail to queue push", "err", err)
 	}
 }
 
-func (c *Client) sendList(clients []string) {
+func (c *Client) sendList(clients []ClientInfo) {
 	ser, _ := json.Marshal(clients)
 	cmd := make(map[string]string)
 	cmd["REQ"] = "SUBSCRIBE_TO_LIST_CONNECTED_USERS"
@@ -149,33 +222,251 @@ func (c *Client) sendList(clients []string) {
 		Command:  cmd,
 		Response: Ok,
 	}
-	writeMessage(msg, c.conn)
+	err := c.out.push(msg, priorityNormal)
+	if err != nil {
+		c.logger().debug("Fail to queue list of clients", "err", err)
+	}
+}
+
+// Sends the reason to the client and closes its connection, so the client ends
+// as soon as its next read fails.
+func (c *Client) kick(reason string) {
+	p, _ := NewPayloadFrom(QuitPayload{Reason: reason})
+	msg := Message{
+		Response: Quit,
+		Payload:  p,
+	}
+	_ = c.conn.SetWriteDeadline(time.Now().Add(rejectWriteTimeOut))
+	err := writeMessage(msg, c.conn)
+	if err != nil {
+		c.logger().warn("Fail to send kick reason", "err", err)
+	}
+	c.conn.Close()
+	c.throttle.stop()
+}
+
+// Returns the info of the client. It's safe to call it from other goroutines.
+func (c *Client) info() ClientInfo {
+	state, transfer, active := c.state.status.read()
+	session := c.state.status.readSession()
+	info := ClientInfo{
+		CID:           c.id,
+		Address:       c.conn.RemoteAddr().String(),
+		Channel:       c.channel().Name,
+		State:         state,
+		Bytes:         session.Bytes,
+		Connected:     session.Connected,
+		LastActivity:  session.LastActivity,
+		Admin:         c.isAdmin(),
+		Profile:       c.state.status.readProfile(),
+		Subscriptions: c.state.status.readSubscriptions(),
+	}
+	if active {
+		info.Action = transfer.Action
+		info.File = transfer.File
+	}
+	return info
+}
+
+// Returns the transfer in progress of the client, or false if there's none.
+// It's safe to call it from other goroutines.
+func (c *Client) transfer() (TransferInfo, bool) {
+	_, info, active := c.state.status.read()
+	info.CID = c.id
+	info.Percent = transferPercent(info)
+	return info, active
+}
+
+// Returns the clients connected to the Hub.
+func (c *Client) requestClients() []*Client {
+	reply := make(chan []*Client, 1)
+	c.inspect <- reply
+	return <-reply
+}
+
+// Disconnects the client with the given ID through the Hub.
+func (c *Client) requestKick(cid uint, reason string) error {
+	done := make(chan error, 1)
+	c.kicks <- kickRequest{cid: cid, reason: reason, done: done}
+	return <-done
 }
 
 func (c *Client) handleReadError(err error, msg string) {
-	log.Println(msg, err)
+	c.logger().warn(msg, "err", err)
 	c.sendQuit()
 }
 
+// Signals every goroutine of the client to end. It's safe to call it more than
+// once.
 func (c *Client) sendQuit() {
-	go func() {
-		c.quit <- struct{}{}
-	}()
+	c.quitOnce.Do(func() {
+		close(c.quit)
+	})
+	c.throttle.stop()
+}
+
+// Returns the logger with the context of the client. It's safe to call it from
+// other goroutines, like the outbox writer.
+func (c *Client) logger() logger {
+	return c.svc.log.with(
+		"cid", c.id,
+		"addr", c.conn.RemoteAddr().String(),
+		"channel", c.channel().Name,
+		"transfer", c.state.status.readLastTransfer(),
+	)
+}
+
+// Records the operation of the client into the audit log.
+func (c *Client) audit(e AuditEntry) {
+	e.Time = time.Now()
+	e.CID = c.id
+	e.Address = c.conn.RemoteAddr().String()
+	if c.isAdmin() {
+		e.User = "admin"
+	}
+	err := c.svc.audit.record(e)
+	if err != nil {
+		c.logger().error("Fail to write audit entry", "err", err)
+	}
 }
 
-func (c Client) cid() uint {
+// Returns the client identity passed to the hooks.
+func (c *Client) hookClient() hooks.Client {
+	return hooks.Client{
+		CID:     c.id,
+		Address: c.conn.RemoteAddr().String(),
+		Channel: c.channel().Name,
+	}
+}
+
+func (c *Client) cid() uint {
 	return c.id
 }
 
+func (c *Client) isAdmin() bool {
+	return c.state.status.isAdmin()
+}
+
+func (c *Client) grantAdmin() {
+	c.state.status.grantAdmin()
+}
+
+// Subscribes the client to the channel, in addition to the ones it's already
+// subscribed to, and makes it its current channel.
 func (c *Client) subscribe(channel process.Channel) {
-	c.state.channel = channel
+	if c.state.status.subscribe(channel) {
+		c.requestSubscription(channel, true)
+	}
 	go func() {
 		c.clientHubChange <- struct{}{}
 	}()
 }
 
-func (c Client) channel() process.Channel {
-	return c.state.channel
+// Unsubscribes the client from the channel. If it was its current channel, the
+// last one subscribed becomes the current channel.
+func (c *Client) unsubscribe(channel process.Channel) {
+	if !c.state.status.unsubscribe(channel) {
+		return
+	}
+	c.requestSubscription(channel, false)
+	go func() {
+		c.clientHubChange <- struct{}{}
+	}()
+}
+
+func (c *Client) requestSubscription(channel process.Channel, subscribe bool) {
+	c.subscription <- subscriptionRequest{
+		client:    c,
+		channel:   channel.Name,
+		subscribe: subscribe,
+		profile:   c.profile(),
+	}
+}
+
+// Returns the channels the client is subscribed to.
+func (c *Client) subscriptions() []string {
+	return c.state.status.readSubscriptions()
+}
+
+func (c *Client) profile() Profile {
+	return c.state.status.readProfile()
+}
+
+// Sets the profile of the client and sends it to the other clients of the
+// channels it's subscribed to.
+func (c *Client) setProfile(profile Profile) {
+	c.state.status.setProfile(profile)
+	for _, channel := range c.subscriptions() {
+		c.announce(PresenceUpdated, process.NewChannel(channel))
+	}
+}
+
+// Relays the message to the other clients of its channel through the Hub.
+func (c *Client) relayChat(m ChatPayload) {
+	c.chat <- m
+}
+
+// Sends the presence event of the client to the other clients of the channel,
+// if it's not empty.
+func (c *Client) announce(event PresenceEvent, channel process.Channel) {
+	if channel.Name == "" {
+		return
+	}
+	c.presence <- PresencePayload{
+		Event:   event,
+		CID:     c.id,
+		Channel: channel.Name,
+		Profile: c.profile(),
+	}
+}
+
+// Starts or stops receiving the changes of the file of the channel, or returns
+// false if the client was already doing so.
+func (c *Client) watchFile(channel process.Channel, path string, watch bool) bool {
+	file := watchKey(channel.Name, path)
+	if _, ok := c.watches[file]; ok == watch {
+		return false
+	}
+	if watch {
+		c.watches[file] = struct{}{}
+	} else {
+		delete(c.watches, file)
+	}
+	c.watch <- watchRequest{client: c, file: file, watch: watch}
+	return true
+}
+
+// Returns the number of files watched by the client.
+func (c *Client) watchCount() int {
+	return len(c.watches)
+}
+
+// Starts or stops receiving the progress events of the transfers done in the
+// channel.
+func (c *Client) observeChannel(channel process.Channel, observe bool) {
+	c.observe <- observeRequest{client: c, channel: channel.Name, observe: observe}
+}
+
+// Starts or stops receiving the updates of all channels, instead of only the
+// ones of the channel the client is subscribed to.
+func (c *Client) subscribeGlobalUpdates(global bool) {
+	c.setGlobal <- globalRequest{client: c, global: global}
+}
+
+// Notifies the clients of the channel about the change made by this client.
+func (c *Client) notifyChange(u UpdatePayload) {
+	u.CID = c.id
+	c.change <- u
+}
+
+// Sends the progress event of the client transfer to the Hub.
+func (c *Client) emitProgress(p ProgressPayload) {
+	p.CID = c.id
+	c.activity <- p
+}
+
+func (c *Client) channel() process.Channel {
+	return c.state.status.readChannel()
 }
 
 func (c *Client) requestClientList() {
@@ -183,5 +474,6 @@ func (c *Client) requestClientList() {
 }
 
 func (c *Client) error(msg string) {
+	c.svc.metrics.error(msg)
 	writeErrorState(msg, c.conn)
 }
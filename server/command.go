@@ -5,31 +5,68 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
+	"fs"
 	"fs/files"
+	"fs/hooks"
 	"fs/process"
-	"log"
+	"fs/utils"
 	"net"
+	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type req string
 
 const (
 	Subscribe                     req = "SUBSCRIBE"
+	Unsubscribe                   req = "UNSUBSCRIBE"
+	ListSubscriptions             req = "LIST_SUBSCRIPTIONS"
+	WatchFile                     req = "WATCH_FILE"
+	UnwatchFile                   req = "UNWATCH_FILE"
+	ListVersions                  req = "LIST_VERSIONS"
+	RestoreVersion                req = "RESTORE_VERSION"
+	ListTrash                     req = "LIST_TRASH"
+	RestoreTrash                  req = "RESTORE_TRASH"
+	EmptyTrash                    req = "EMPTY_TRASH"
+	SetMetadata                   req = "SET_METADATA"
+	GetMetadata                   req = "GET_METADATA"
+	RemoveMetadata                req = "REMOVE_METADATA"
+	Stat                          req = "STAT"
 	CreateChannel                 req = "CREATE_CHANNEL"
 	DeleteChannel                 req = "DELETE_CHANNEL"
 	ListChannels                  req = "LIST_CHANNELS"
 	ListFiles                     req = "LIST_FILES"
+	DeleteFile                    req = "DELETE_FILE"
 	CID                           req = "CID"
 	ConnectedUsers                req = "CONNECTED_USERS"
 	SubscribeToListConnectedUsers req = "SUBSCRIBE_TO_LIST_CONNECTED_USERS"
+	SubscribeGlobalUpdates        req = "SUBSCRIBE_GLOBAL_UPDATES"
+	UnsubscribeGlobalUpdates      req = "UNSUBSCRIBE_GLOBAL_UPDATES"
+	CatchUp                       req = "CATCH_UP"
+	SetProfile                    req = "SET_PROFILE"
+	SendMessage                   req = "MESSAGE"
+	History                       req = "HISTORY"
+	Admin                         req = "ADMIN"
+	Quota                         req = "QUOTA"
+	SetQuota                      req = "SET_QUOTA"
+	SetRateLimit                  req = "SET_RATE_LIMIT"
+	Audit                         req = "AUDIT"
+	SubscribeActivity             req = "SUBSCRIBE_ACTIVITY"
+	UnsubscribeActivity           req = "UNSUBSCRIBE_ACTIVITY"
+	ListTransfers                 req = "LIST_TRANSFERS"
+	AbortTransfer                 req = "ABORT_TRANSFER"
+	Kick                          req = "KICK"
 )
 
 type command struct {
 	conn net.Conn
 	commandClient
+	svc             *services
 	clientHubChange chan struct{}
 	quit            chan struct{}
 }
@@ -37,23 +74,67 @@ type command struct {
 func newCommand(
 	conn net.Conn,
 	client commandClient,
+	svc *services,
 	clientHubChange chan struct{},
 	quit chan struct{},
 ) command {
 	return command{
 		conn:            conn,
 		commandClient:   client,
+		svc:             svc,
 		clientHubChange: clientHubChange,
 		quit:            quit,
 	}
 }
 
+var errInvalidReq = errors.New("invalid command request")
+
+const (
+	maxSubscriptions = 64 // Max number of channels a client can be subscribed to
+	maxWatches       = 64 // Max number of files a client can watch
+)
+
 func (c command) execute(cmd map[string]string) error {
 	req := req(cmd["REQ"])
+	err := c.run(req, cmd)
+	if err == errInvalidReq {
+		c.svc.metrics.command("INVALID")
+	} else {
+		c.svc.metrics.command(req)
+	}
+	return err
+}
 
+func (c command) run(req req, cmd map[string]string) error {
 	switch req {
 	case Subscribe:
 		return c.subscribe(cmd)
+	case Unsubscribe:
+		return c.unsubscribe(cmd)
+	case ListSubscriptions:
+		return c.listSubscriptions()
+	case WatchFile:
+		return c.watchFile(cmd, true)
+	case UnwatchFile:
+		return c.watchFile(cmd, false)
+	case ListVersions:
+		return c.listVersions(cmd)
+	case RestoreVersion:
+		return c.restoreVersion(cmd)
+	case ListTrash:
+		return c.listTrash(cmd)
+	case RestoreTrash:
+		return c.restoreTrash(cmd)
+	case EmptyTrash:
+		return c.emptyTrash(cmd)
+	case SetMetadata:
+		return c.setMetadata(cmd)
+	case GetMetadata:
+		return c.getMetadata(cmd)
+	case RemoveMetadata:
+		return c.removeMetadata(cmd)
+	case Stat:
+		return c.stat(cmd)
 	case CreateChannel:
 		return c.createChannel(cmd)
 	case DeleteChannel:
@@ -62,6 +143,8 @@ func (c command) execute(cmd map[string]string) error {
 		return c.listChannels()
 	case ListFiles:
 		return c.listFiles(cmd)
+	case DeleteFile:
+		return c.deleteFile(cmd)
 	case CID:
 		return c.sendCID()
 	case ConnectedUsers:
@@ -69,53 +152,146 @@ func (c command) execute(cmd map[string]string) error {
 		c.requestClientList()
 	case SubscribeToListConnectedUsers:
 		return c.subscribeToListConnectedUsers()
+	case SubscribeGlobalUpdates:
+		c.subscribeGlobalUpdates(true)
+		return c.respond(SubscribeGlobalUpdates, Ok, "")
+	case UnsubscribeGlobalUpdates:
+		c.subscribeGlobalUpdates(false)
+		return c.respond(UnsubscribeGlobalUpdates, Ok, "")
+	case CatchUp:
+		return c.catchUp(cmd)
+	case SetProfile:
+		return c.setProfile(cmd)
+	case SendMessage:
+		return c.sendMessage(cmd)
+	case History:
+		return c.history(cmd)
+	case Admin:
+		return c.admin(cmd)
+	case Quota:
+		return c.quota(cmd)
+	case SetQuota:
+		return c.setQuota(cmd)
+	case SetRateLimit:
+		return c.setRateLimit(cmd)
+	case Audit:
+		return c.queryAudit(cmd)
+	case SubscribeActivity:
+		return c.subscribeActivity(cmd, true)
+	case UnsubscribeActivity:
+		return c.subscribeActivity(cmd, false)
+	case ListTransfers:
+		return c.listTransfers()
+	case AbortTransfer:
+		return c.abortTransfer(cmd)
+	case Kick:
+		return c.kick(cmd)
 	default:
-		return errors.New("invalid command request")
+		return errInvalidReq
 	}
 	return nil
 }
 
+// Subscribes the client to the CHANNEL, in addition to the ones it's already
+// subscribed to.
 func (c command) subscribe(cmd map[string]string) error {
-	name := cmd["CHANNEL"]
-	c.commandClient.subscribe(process.Channel{Name: name})
+	channel := process.NewChannel(cmd["CHANNEL"])
+	if _, err := channel.File(); err != nil || channel.Name == "" {
+		return errors.New("invalid channel")
+	}
+	list := c.subscriptions()
+	if len(list) >= maxSubscriptions && !utils.StringSliceContains(list, channel.Name) {
+		return errors.New("too many subscriptions")
+	}
+	c.commandClient.subscribe(channel)
 	return c.respond(Subscribe, Ok, "")
 }
 
+func (c command) unsubscribe(cmd map[string]string) error {
+	channel := process.NewChannel(cmd["CHANNEL"])
+	if !utils.StringSliceContains(c.subscriptions(), channel.Name) {
+		return errors.New("not subscribed to channel")
+	}
+	c.commandClient.unsubscribe(channel)
+	return c.respond(Unsubscribe, Ok, channel.Name)
+}
+
+// Starts or stops pushing the changes of the FILE of the CHANNEL to the client.
+// The file doesn't have to exist, so its creation can be watched too.
+func (c command) watchFile(cmd map[string]string, watch bool) error {
+	channel := process.NewChannel(cmd["CHANNEL"])
+	file, err := channel.File()
+	if err != nil || channel.Name == "" {
+		return errors.New("invalid channel")
+	}
+	name := cmd["FILE"]
+	if err = file.Append(name); err != nil || name == "" {
+		return errors.New("invalid file")
+	}
+	req := WatchFile
+	if !watch {
+		req = UnwatchFile
+	}
+	if watch && c.watchCount() >= maxWatches {
+		return errors.New("too many files watched")
+	}
+	if !c.commandClient.watchFile(channel, name, watch) && !watch {
+		return errors.New("file not watched")
+	}
+	return c.respond(req, Ok, file.Value)
+}
+
+func (c command) listSubscriptions() error {
+	ser, _ := json.Marshal(c.subscriptions())
+	return c.respond(ListSubscriptions, Ok, string(ser))
+}
+
 func (c command) createChannel(cmd map[string]string) error {
 	channelName := cmd["CHANNEL"]
+	err := c.makeChannel(channelName)
+	c.auditChannel(AuditCreateChannel, channelName, err)
+	if err != nil {
+		return err
+	}
+	c.svc.hooks.OnChannelCreated(c.hookClient(), channelName)
+	c.notifyChange(newChange(ChangeChannelCreated, channelName, "", 0))
+	return c.respond(CreateChannel, Ok, "")
+}
+
+func (c command) makeChannel(channelName string) error {
+	if _, err := process.NewChannel(channelName).File(); err != nil {
+		return errors.New("invalid channel")
+	}
 	file, err := getFsRootFile()
 	if err != nil {
-		log.Println(err)
+		c.logger().error("Fail to read FS root", "err", err)
 		return errors.New("server error")
 	}
 	err = file.Append(channelName)
 	if err != nil {
 		return errors.New("invalid channel")
 	}
+	err = c.svc.hooks.OnChannelCreating(c.hookClient(), channelName)
+	if err != nil {
+		return vetoError{err}
+	}
 	err = files.CreateIfNotExists(file)
 	if err != nil {
-		log.Println(err)
+		c.logger().error("Fail to create channel", "err", err)
 		return errors.New("server error")
 	}
-	return c.respond(CreateChannel, Ok, "")
+	return nil
 }
 
 func (c command) deleteChannel(cmd map[string]string) error {
 	name := cmd["CHANNEL"]
-	file, err := getFsRootFile()
+	err := removeChannel(c.svc, c.logger(), process.NewChannel(name), c.hookClient())
+	c.auditChannel(AuditDeleteChannel, name, err)
 	if err != nil {
-		log.Println(err)
-		return errors.New("server error")
-	}
-	err = file.Append(name)
-	if err != nil {
-		return errors.New("invalid channel")
-	}
-	err = files.DeleteIfExists(file)
-	if err != nil {
-		log.Println(err)
-		return errors.New("server error")
+		return err
 	}
+	c.svc.hooks.OnChannelDeleted(c.hookClient(), name)
+	c.notifyChange(newChange(ChangeChannelDeleted, name, "", 0))
 	return c.respond(DeleteChannel, Ok, name)
 }
 
@@ -128,26 +304,228 @@ func (c command) listChannels() error {
 	return c.respond(ListChannels, Ok, string(ser))
 }
 
+// Sends the names of the files of the CHANNEL, or their stats with their
+// metadata if META is true.
 func (c command) listFiles(cmd map[string]string) error {
 	// TODO channel := c.process.User().Channel()
 	channelName := cmd["CHANNEL"]
 	channel := process.NewChannel(channelName)
+	if _, err := channel.File(); err != nil || channelName == "" {
+		c.auditChannel(AuditListFiles, channelName, errors.New("invalid channel"))
+		return errors.New("invalid channel")
+	}
 
 	fileList, err := readFiles(channel)
 	if err != nil {
+		err = errors.New("fail to read list of files")
+	}
+	c.auditChannel(AuditListFiles, channelName, err)
+	if err != nil {
+		return err
+	}
+	if cmd["META"] != "true" {
+		ser, _ := json.Marshal(fileList)
+		return c.respond(ListFiles, Ok, string(ser))
+	}
+	stats, err := readFileStats(c.svc, channel, fileList)
+	if err != nil {
+		c.logger().error("Fail to read files", "channel", channelName, "err", err)
 		return errors.New("fail to read list of files")
 	}
-	ser, _ := json.Marshal(fileList)
+	ser, _ := json.Marshal(stats)
 	return c.respond(ListFiles, Ok, string(ser))
 }
 
+func (c command) deleteFile(cmd map[string]string) error {
+	channel := process.NewChannel(cmd["CHANNEL"])
+	name := cmd["FILE"]
+	size, err := removeFile(c.svc, c.logger(), channel, name, c.hookClient())
+	outcome, msg := auditOutcome(err)
+	c.audit(AuditEntry{
+		Action:  AuditDeleteFile,
+		Channel: channel.Name,
+		File:    name,
+		Size:    uint64(size),
+		Outcome: outcome,
+		Error:   msg,
+	})
+	if err != nil {
+		return err
+	}
+	c.svc.hooks.OnFileDeleted(c.hookClient(), hooks.File{
+		Channel: channel.Name,
+		Path:    name,
+		Size:    uint64(size),
+	})
+	c.notifyChange(newChange(ChangeFileDeleted, channel.Name, name, uint64(size)))
+	return c.respond(DeleteFile, Ok, name)
+}
+
+func (c command) listVersions(cmd map[string]string) error {
+	channel := process.NewChannel(cmd["CHANNEL"])
+	versions, err := c.svc.versions.list(channel, cmd["FILE"])
+	if err != nil {
+		c.logger().error("Fail to read file versions", "err", err)
+		return errors.New("fail to read file versions")
+	}
+	ser, _ := json.Marshal(versions)
+	return c.respond(ListVersions, Ok, string(ser))
+}
+
+// Makes the VERSION of the FILE of the CHANNEL its current content. The
+// content it replaces is kept as a new version.
+func (c command) restoreVersion(cmd map[string]string) error {
+	channel := process.NewChannel(cmd["CHANNEL"])
+	name := cmd["FILE"]
+	version, err := strconv.ParseUint(cmd["VERSION"], 10, 32)
+	if err != nil || version == 0 {
+		return errors.New("invalid VERSION")
+	}
+	size, err := restoreFileVersion(c.svc, c.logger(), channel, name, uint(version), c.hookClient())
+	outcome, msg := auditOutcome(err)
+	c.audit(AuditEntry{
+		Action:  AuditRestoreVersion,
+		Channel: channel.Name,
+		File:    name,
+		Size:    size,
+		Target:  strconv.FormatUint(version, 10),
+		Outcome: outcome,
+		Error:   msg,
+	})
+	if err != nil {
+		return err
+	}
+	u := newChange(ChangeFileReplaced, channel.Name, name, size)
+	u.ModTime = u.Time
+	c.notifyChange(u)
+	return c.respond(RestoreVersion, Ok, strconv.FormatUint(version, 10))
+}
+
+// Sends the items of the trash, only of the CHANNEL if it's given.
+func (c command) listTrash(cmd map[string]string) error {
+	if !c.isAdmin() {
+		return errors.New("permission denied")
+	}
+	ser, _ := json.Marshal(c.svc.trash.list(cmd["CHANNEL"]))
+	return c.respond(ListTrash, Ok, string(ser))
+}
+
+// Moves the channel or file of the trash item with the given ID back to where
+// it was.
+func (c command) restoreTrash(cmd map[string]string) error {
+	if !c.isAdmin() {
+		return errors.New("permission denied")
+	}
+	id, err := strconv.ParseUint(cmd["ID"], 10, 64)
+	if err != nil {
+		return errors.New("invalid ID")
+	}
+	item, err := restoreTrashItem(c.svc, c.logger(), id)
+	outcome, msg := auditOutcome(err)
+	c.audit(AuditEntry{
+		Action:  AuditRestoreTrash,
+		Channel: item.Channel,
+		File:    item.File,
+		Size:    item.Size,
+		Target:  cmd["ID"],
+		Outcome: outcome,
+		Error:   msg,
+	})
+	if err != nil {
+		return err
+	}
+	if item.File == "" {
+		c.notifyChange(newChange(ChangeChannelCreated, item.Channel, "", 0))
+	} else {
+		c.notifyChange(newChange(ChangeFileAdded, item.Channel, item.File, item.Size))
+	}
+	ser, _ := json.Marshal(item)
+	return c.respond(RestoreTrash, Ok, string(ser))
+}
+
+// Deletes for good the items of the trash, only of the CHANNEL if it's given.
+func (c command) emptyTrash(cmd map[string]string) error {
+	if !c.isAdmin() {
+		return errors.New("permission denied")
+	}
+	n, err := c.svc.trash.empty(cmd["CHANNEL"])
+	c.auditChannel(AuditEmptyTrash, cmd["CHANNEL"], err)
+	if err != nil {
+		c.logger().error("Fail to empty trash", "err", err)
+		return errors.New("fail to empty trash")
+	}
+	c.svc.blobs.sweep()
+	return c.respond(EmptyTrash, Ok, strconv.Itoa(n))
+}
+
+// Adds the METADATA, a JSON object of strings, and the comma separated TAGS to
+// the FILE of the CHANNEL.
+func (c command) setMetadata(cmd map[string]string) error {
+	channel := process.NewChannel(cmd["CHANNEL"])
+	name := cmd["FILE"]
+	_, err := statFile(c.svc, channel, name, FileMeta{})
+	if err != nil {
+		return err
+	}
+	meta, err := parseFileMeta(cmd)
+	if err != nil {
+		return err
+	}
+	meta, err = c.svc.meta.set(channel, name, meta)
+	if err != nil {
+		return err
+	}
+	ser, _ := json.Marshal(meta)
+	return c.respond(SetMetadata, Ok, string(ser))
+}
+
+func (c command) getMetadata(cmd map[string]string) error {
+	channel := process.NewChannel(cmd["CHANNEL"])
+	meta, err := c.svc.meta.get(channel, cmd["FILE"])
+	if err != nil {
+		return errors.New("fail to read file metadata")
+	}
+	ser, _ := json.Marshal(meta)
+	return c.respond(GetMetadata, Ok, string(ser))
+}
+
+// Removes the comma separated metadata KEYS and TAGS of the FILE of the
+// CHANNEL, or all of them if none is given.
+func (c command) removeMetadata(cmd map[string]string) error {
+	channel := process.NewChannel(cmd["CHANNEL"])
+	keys := parseList(cmd["KEYS"])
+	tags := parseList(cmd["TAGS"])
+	meta, err := c.svc.meta.remove(channel, cmd["FILE"], keys, tags)
+	if err != nil {
+		return errors.New("fail to remove file metadata")
+	}
+	ser, _ := json.Marshal(meta)
+	return c.respond(RemoveMetadata, Ok, string(ser))
+}
+
+// Sends the size, modification time and metadata of the FILE of the CHANNEL.
+func (c command) stat(cmd map[string]string) error {
+	channel := process.NewChannel(cmd["CHANNEL"])
+	name := cmd["FILE"]
+	meta, err := c.svc.meta.get(channel, name)
+	if err != nil {
+		return errors.New("fail to read file metadata")
+	}
+	stat, err := statFile(c.svc, channel, name, meta)
+	if err != nil {
+		return err
+	}
+	ser, _ := json.Marshal(stat)
+	return c.respond(Stat, Ok, string(ser))
+}
+
 func (c command) sendCID() error {
 	payload := strconv.Itoa(int(c.cid()))
 	return c.respond(CID, Ok, payload)
 }
 
 func (c command) subscribeToListConnectedUsers() error {
-	log.Println("Subscribing client to listen for connected users")
+	c.logger().info("Subscribing client to listen for connected users")
 	go func() {
 		for {
 			select {
@@ -161,6 +539,275 @@ func (c command) subscribeToListConnectedUsers() error {
 	return nil
 }
 
+// Sends the changes after the SEQ given, only of the CHANNEL if it's given.
+func (c command) catchUp(cmd map[string]string) error {
+	seq, err := strconv.ParseUint(cmd["SEQ"], 10, 64)
+	if err != nil {
+		return errors.New("invalid SEQ")
+	}
+	payload := c.svc.events.since(seq, cmd["CHANNEL"])
+	ser, _ := json.Marshal(payload)
+	return c.respond(CatchUp, Ok, string(ser))
+}
+
+// Sets the NAME, DEVICE and STATUS of the client that are given.
+func (c command) setProfile(cmd map[string]string) error {
+	profile, err := parseProfile(cmd, c.profile())
+	if err != nil {
+		return err
+	}
+	c.commandClient.setProfile(profile)
+	ser, _ := json.Marshal(profile)
+	return c.respond(SetProfile, Ok, string(ser))
+}
+
+// Sends the TEXT to the clients of the CHANNEL, which is the current channel of
+// the client if not given.
+func (c command) sendMessage(cmd map[string]string) error {
+	channel, err := c.readChannelArg(cmd)
+	if err != nil {
+		return err
+	}
+	text, err := parseChatText(cmd["TEXT"])
+	if err != nil {
+		return err
+	}
+	msg, err := c.svc.chat.append(ChatPayload{
+		Channel: channel.Name,
+		CID:     c.cid(),
+		Name:    c.profile().Name,
+		Text:    text,
+		Time:    time.Now(),
+	})
+	if err != nil {
+		c.logger().error("Fail to save message", "err", err)
+		return errors.New("fail to save message")
+	}
+	c.relayChat(msg)
+	ser, _ := json.Marshal(msg)
+	return c.respond(SendMessage, Ok, string(ser))
+}
+
+// Sends up to LIMIT messages of the CHANNEL before the message with ID BEFORE,
+// or the last ones if it's not given.
+func (c command) history(cmd map[string]string) error {
+	channel, err := c.readChannelArg(cmd)
+	if err != nil {
+		return err
+	}
+	var before uint64
+	if value := cmd["BEFORE"]; value != "" {
+		if before, err = strconv.ParseUint(value, 10, 64); err != nil {
+			return errors.New("invalid BEFORE")
+		}
+	}
+	var limit int
+	if value := cmd["LIMIT"]; value != "" {
+		if limit, err = strconv.Atoi(value); err != nil {
+			return errors.New("invalid LIMIT")
+		}
+	}
+	payload, err := c.svc.chat.page(channel.Name, before, limit)
+	if err != nil {
+		c.logger().error("Fail to read message history", "err", err)
+		return errors.New("fail to read message history")
+	}
+	ser, _ := json.Marshal(payload)
+	return c.respond(History, Ok, string(ser))
+}
+
+// Returns the existing CHANNEL given, or the current channel of the client.
+func (c command) readChannelArg(cmd map[string]string) (process.Channel, error) {
+	name := cmd["CHANNEL"]
+	if name == "" {
+		name = c.channel().Name
+	}
+	channel := process.NewChannel(name)
+	file, err := channel.File()
+	if err != nil || name == "" {
+		return channel, errors.New("invalid channel")
+	}
+	exists, err := files.Exists(file.ToOsFile(c.svc.osFsRoot))
+	if err != nil || !exists {
+		return channel, errors.New("channel not found")
+	}
+	return channel, nil
+}
+
+func (c command) admin(cmd map[string]string) error {
+	token := []byte(cmd["TOKEN"])
+	expected := []byte(c.svc.cfg.adminToken)
+	if len(expected) == 0 || subtle.ConstantTimeCompare(token, expected) != 1 {
+		return errors.New("invalid admin token")
+	}
+	c.grantAdmin()
+	return c.respond(Admin, Ok, "")
+}
+
+func (c command) quota(cmd map[string]string) error {
+	channel := process.NewChannel(cmd["CHANNEL"])
+	if _, err := channel.File(); err != nil {
+		return errors.New("invalid channel")
+	}
+	report, err := c.svc.quotas.report(channel)
+	if err != nil {
+		c.logger().error("Fail to read channel quota", "err", err)
+		return errors.New("fail to read channel quota")
+	}
+	ser, _ := json.Marshal(report)
+	return c.respond(Quota, Ok, string(ser))
+}
+
+func (c command) setQuota(cmd map[string]string) error {
+	if !c.isAdmin() {
+		return errors.New("permission denied")
+	}
+	channel := process.NewChannel(cmd["CHANNEL"])
+	if _, err := channel.File(); err != nil {
+		return errors.New("invalid channel")
+	}
+	maxBytes, err := parseLimit(cmd["MAX_BYTES"])
+	if err != nil {
+		return errors.New("invalid MAX_BYTES")
+	}
+	maxFiles, err := parseLimit(cmd["MAX_FILES"])
+	if err != nil {
+		return errors.New("invalid MAX_FILES")
+	}
+	quota := process.Quota{MaxBytes: maxBytes, MaxFiles: maxFiles}
+	err = c.svc.quotas.set(channel, quota)
+	if err != nil {
+		c.logger().error("Fail to save channel quota", "err", err)
+		return errors.New("fail to save channel quota")
+	}
+	return c.respond(SetQuota, Ok, channel.Name)
+}
+
+func (c command) setRateLimit(cmd map[string]string) error {
+	if !c.isAdmin() {
+		return errors.New("permission denied")
+	}
+	scope := RateScope(cmd["SCOPE"])
+	rate, err := strconv.ParseInt(cmd["RATE"], 10, 64)
+	if err != nil || rate < 0 {
+		return errors.New("invalid RATE")
+	}
+	action, err := parseOptionalAction(cmd["ACTION"])
+	if err != nil {
+		return err
+	}
+	channel := process.NewChannel(cmd["CHANNEL"])
+	err = c.svc.throttle.set(scope, action, channel, rate)
+	if err != nil {
+		return err
+	}
+	return c.respond(SetRateLimit, Ok, string(scope))
+}
+
+func (c command) queryAudit(cmd map[string]string) error {
+	if !c.isAdmin() {
+		return errors.New("permission denied")
+	}
+	filter, err := parseAuditFilter(cmd)
+	if err != nil {
+		return err
+	}
+	entries, err := c.svc.audit.query(filter)
+	if err != nil {
+		c.logger().error("Fail to read audit log", "err", err)
+		return errors.New("fail to read audit log")
+	}
+	ser, _ := json.Marshal(entries)
+	return c.respond(Audit, Ok, string(ser))
+}
+
+// Starts or stops sending to the client the progress of the transfers of the
+// given channel.
+func (c command) subscribeActivity(cmd map[string]string, observe bool) error {
+	channel := process.NewChannel(cmd["CHANNEL"])
+	if _, err := channel.File(); err != nil || channel.Name == "" {
+		return errors.New("invalid channel")
+	}
+	c.observeChannel(channel, observe)
+	req := SubscribeActivity
+	if !observe {
+		req = UnsubscribeActivity
+	}
+	return c.respond(req, Ok, channel.Name)
+}
+
+func (c command) listTransfers() error {
+	if !c.isAdmin() {
+		return errors.New("permission denied")
+	}
+	ser, _ := json.Marshal(readTransfers(c.requestClients()))
+	return c.respond(ListTransfers, Ok, string(ser))
+}
+
+func (c command) abortTransfer(cmd map[string]string) error {
+	if !c.isAdmin() {
+		return errors.New("permission denied")
+	}
+	id, err := strconv.ParseUint(cmd["TRANSFER"], 10, 64)
+	if err != nil {
+		return errors.New("invalid TRANSFER")
+	}
+	for _, client := range c.requestClients() {
+		info, active := client.transfer()
+		if !active || !client.state.status.abort(id) {
+			continue
+		}
+		client.throttle.interrupt()
+		c.logger().info("Aborting transfer", "target", id, "target_cid", info.CID)
+		c.audit(AuditEntry{
+			Action:  AuditAbortTransfer,
+			Target:  strconv.FormatUint(id, 10),
+			Channel: info.Channel,
+			File:    info.File,
+			Size:    info.Bytes,
+			Outcome: AuditSuccess,
+		})
+		return c.respond(AbortTransfer, Ok, strconv.FormatUint(id, 10))
+	}
+	return errors.New("transfer not found")
+}
+
+func (c command) kick(cmd map[string]string) error {
+	if !c.isAdmin() {
+		return errors.New("permission denied")
+	}
+	cid, err := strconv.ParseUint(cmd["CID"], 10, 64)
+	if err != nil {
+		return errors.New("invalid CID")
+	}
+	reason := cmd["REASON"]
+	if reason == "" {
+		reason = defaultKickReason
+	}
+	err = c.requestKick(uint(cid), reason)
+	outcome, msg := auditOutcome(err)
+	c.audit(AuditEntry{
+		Action:  AuditKick,
+		Target:  strconv.FormatUint(cid, 10),
+		Outcome: outcome,
+		Error:   msg,
+	})
+	if err != nil {
+		return err
+	}
+	return c.respond(Kick, Ok, strconv.FormatUint(cid, 10))
+}
+
+func (c command) auditChannel(action AuditAction, channel string, err error) {
+	outcome, msg := auditOutcome(err)
+	c.audit(AuditEntry{
+		Action:  action,
+		Channel: channel,
+		Outcome: outcome,
+		Error:   msg,
+	})
+}
+
 func (c command) respond(req req, res Response, payload string) error {
 	cmd := make(map[string]string)
 	cmd["REQ"] = string(req)
@@ -174,19 +821,330 @@ func (c command) respond(req req, res Response, payload string) error {
 
 type commandClient interface {
 	cid() uint
+	logger() logger
+	isAdmin() bool
+	grantAdmin()
+	audit(e AuditEntry)
+	hookClient() hooks.Client
 	subscribe(channel process.Channel)
+	unsubscribe(channel process.Channel)
+	subscriptions() []string
+	watchFile(channel process.Channel, path string, watch bool) bool
+	watchCount() int
+	channel() process.Channel
+	profile() Profile
+	setProfile(profile Profile)
+	observeChannel(channel process.Channel, observe bool)
+	subscribeGlobalUpdates(global bool)
+	relayChat(m ChatPayload)
+	notifyChange(u UpdatePayload)
 	requestClientList()
+	requestClients() []*Client
+	requestKick(cid uint, reason string) error
+}
+
+// Parses an optional action name, where an empty value means all actions.
+func parseOptionalAction(value string) (*process.Action, error) {
+	if value == "" {
+		return nil, nil
+	}
+	for i, name := range process.Actions() {
+		if name == value {
+			action := process.Action(i)
+			return &action, nil
+		}
+	}
+	return nil, errors.New("invalid action")
 }
 
+// Reads the AUDIT filter from the FROM and TO times in RFC 3339, and the
+// CHANNEL, CID and LIMIT values, which are all optional.
+func parseAuditFilter(cmd map[string]string) (AuditFilter, error) {
+	filter := AuditFilter{Channel: cmd["CHANNEL"]}
+	var err error
+	if value := cmd["FROM"]; value != "" {
+		if filter.From, err = time.Parse(time.RFC3339, value); err != nil {
+			return filter, errors.New("invalid FROM")
+		}
+	}
+	if value := cmd["TO"]; value != "" {
+		if filter.To, err = time.Parse(time.RFC3339, value); err != nil {
+			return filter, errors.New("invalid TO")
+		}
+	}
+	if value := cmd["CID"]; value != "" {
+		cid, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return filter, errors.New("invalid CID")
+		}
+		id := uint(cid)
+		filter.CID = &id
+	}
+	if value := cmd["LIMIT"]; value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil {
+			return filter, errors.New("invalid LIMIT")
+		}
+	}
+	return filter, nil
+}
+
+// Parses an optional limit value, where an empty value means unlimited.
+func parseLimit(value string) (uint64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
+
+// vetoError An operation vetoed by a pre-hook. Its message is sent to the
+// client that requested the operation.
+type vetoError struct {
+	error
+}
+
+// Moves the channel with all its files and versions to the trash. It does
+// nothing if the channel doesn't exist, and it fails if a pre-hook vetoes it.
+func removeChannel(svc *services, log logger, channel process.Channel, by hooks.Client) error {
+	file, err := channel.File()
+	if err != nil || channel.Name == "" {
+		return errors.New("invalid channel")
+	}
+	osFile := file.ToOsFile(svc.osFsRoot)
+	exists, err := files.Exists(osFile)
+	if err != nil {
+		log.error("Fail to read channel", "channel", channel.Name, "err", err)
+		return errors.New("server error")
+	}
+	if !exists {
+		return nil
+	}
+	err = svc.hooks.OnChannelDeleting(by, channel.Name)
+	if err != nil {
+		return vetoError{err}
+	}
+	size, _, err := files.ReadDirSize(osFile)
+	if err != nil {
+		log.error("Fail to read channel size", "channel", channel.Name, "err", err)
+		return errors.New("server error")
+	}
+	item, err := svc.trash.put(TrashItem{
+		Channel: channel.Name,
+		Size:    uint64(size),
+		CID:     by.CID,
+		User:    by.User,
+		Address: by.Address,
+	}, osFile.Path())
+	if err != nil {
+		log.error("Fail to move channel to trash", "channel", channel.Name, "err", err)
+		return errors.New("server error")
+	}
+	svc.quotas.invalidate(channel)
+	svc.throttle.removeChannel(channel)
+	err = svc.versions.moveChannel(channel, svc.trash.itemDir(item.ID)+fs.Separator+trashVersions)
+	if err != nil {
+		log.error("Fail to move channel versions to trash", "channel", channel.Name, "err", err)
+	}
+	err = svc.meta.moveChannel(channel, svc.trash.itemDir(item.ID)+fs.Separator+trashMeta)
+	if err != nil {
+		log.error("Fail to move channel metadata to trash", "channel", channel.Name, "err", err)
+	}
+	err = svc.chat.remove(channel.Name)
+	if err != nil {
+		log.error("Fail to delete channel messages", "channel", channel.Name, "err", err)
+	}
+	return nil
+}
+
+// Moves the channel or file of the trash item back to where it was, and
+// returns the item restored. It fails if something took its place meanwhile.
+func restoreTrashItem(svc *services, log logger, id uint64) (TrashItem, error) {
+	return svc.trash.restore(id, func(item TrashItem, dir string) error {
+		channel := process.NewChannel(item.Channel)
+		file, err := channel.File()
+		if err != nil {
+			return errors.New("invalid channel")
+		}
+		channelFile := file.ToOsFile(svc.osFsRoot)
+		if item.File != "" {
+			err = file.Append(item.File)
+			if err != nil {
+				return errors.New("invalid file")
+			}
+		}
+		osFile := file.ToOsFile(svc.osFsRoot)
+		exists, err := files.Exists(osFile)
+		if err != nil {
+			log.error("Fail to read file", "path", file.Value, "err", err)
+			return errors.New("server error")
+		}
+		if exists {
+			return errors.New("a file with the same name exists")
+		}
+		if item.File == "" {
+			err = os.Rename(dir+fs.Separator+trashContent, osFile.Path())
+			if err != nil {
+				log.error("Fail to restore channel", "channel", item.Channel, "err", err)
+				return errors.New("fail to restore channel")
+			}
+			svc.quotas.invalidate(channel)
+			err = svc.versions.restoreChannel(channel, dir+fs.Separator+trashVersions)
+			if err != nil {
+				log.error("Fail to restore channel versions", "channel", item.Channel, "err", err)
+			}
+			err = svc.meta.restoreChannel(channel, dir+fs.Separator+trashMeta)
+			if err != nil {
+				log.error("Fail to restore channel metadata", "channel", item.Channel, "err", err)
+			}
+			return nil
+		}
+		err = svc.quotas.Reserve(channel, int64(item.Size), 1)
+		if err != nil {
+			return err
+		}
+		err = files.CreateIfNotExists(channelFile)
+		if err == nil {
+			err = os.Rename(dir+fs.Separator+trashContent, osFile.Path())
+		}
+		if err != nil {
+			log.error("Fail to restore file", "path", file.Value, "err", err)
+			svc.quotas.Add(channel, -int64(item.Size), -1)
+			return errors.New("fail to restore file")
+		}
+		if !item.Meta.isEmpty() {
+			_, err = svc.meta.set(channel, item.File, item.Meta)
+			if err != nil {
+				log.error("Fail to restore file metadata", "path", file.Value, "err", err)
+			}
+		}
+		return nil
+	})
+}
+
+// Restores the version of the file of the channel and returns its size.
+func restoreFileVersion(
+	svc *services,
+	log logger,
+	channel process.Channel,
+	name string,
+	version uint,
+	client hooks.Client,
+) (uint64, error) {
+	versionFile, err := svc.versions.File(channel, name, version)
+	if err != nil {
+		return 0, err
+	}
+	file, _ := channel.File()
+	_ = file.Append(name)
+	osFile := file.ToOsFile(svc.osFsRoot)
+	size, err := files.ReadSize(versionFile)
+	if err != nil {
+		log.error("Fail to read file version", "file", name, "err", err)
+		return 0, errors.New("server error")
+	}
+	prevSize, err := files.ReadSize(osFile)
+	newFiles := int64(0)
+	if errors.Is(err, os.ErrNotExist) {
+		prevSize, newFiles, err = 0, 1, nil
+	}
+	if err != nil {
+		log.error("Fail to read file", "file", name, "err", err)
+		return 0, errors.New("server error")
+	}
+	err = svc.quotas.Reserve(channel, size-prevSize, newFiles)
+	if err != nil {
+		return 0, err
+	}
+	err = svc.versions.restore(channel, name, version, osFile, client)
+	if err != nil {
+		log.error("Fail to restore file version", "file", name, "err", err)
+		svc.quotas.Add(channel, prevSize-size, -newFiles)
+		return 0, errors.New("fail to restore file version")
+	}
+	err = svc.blobs.store(osFile.Path())
+	if err != nil {
+		log.error("Fail to store file blob", "file", name, "err", err)
+	}
+	return uint64(size), nil
+}
+
+// Moves the file of the channel to the trash and returns its size. It fails if
+// a pre-hook vetoes it.
+func removeFile(
+	svc *services,
+	log logger,
+	channel process.Channel,
+	name string,
+	by hooks.Client,
+) (int64, error) {
+	file, err := channel.File()
+	if err != nil || channel.Name == "" {
+		return 0, errors.New("invalid channel")
+	}
+	err = file.Append(name)
+	if err != nil || name == "" {
+		return 0, errors.New("invalid file")
+	}
+	osFile := file.ToOsFile(svc.osFsRoot)
+	size, err := files.ReadSize(osFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, errors.New("file not found")
+	}
+	if err != nil {
+		log.error("Fail to read file", "file", name, "err", err)
+		return 0, errors.New("server error")
+	}
+	err = svc.hooks.OnFileDeleting(by, hooks.File{
+		Channel: channel.Name,
+		Path:    name,
+		Size:    uint64(size),
+	})
+	if err != nil {
+		return 0, vetoError{err}
+	}
+	meta, err := svc.meta.get(channel, name)
+	if err != nil {
+		log.error("Fail to read file metadata", "file", name, "err", err)
+	}
+	_, err = svc.trash.put(TrashItem{
+		Channel: channel.Name,
+		File:    name,
+		Size:    uint64(size),
+		Meta:    meta,
+		CID:     by.CID,
+		User:    by.User,
+		Address: by.Address,
+	}, osFile.Path())
+	if err != nil {
+		log.error("Fail to move file to trash", "file", name, "err", err)
+		return 0, errors.New("fail to delete file")
+	}
+	svc.quotas.Add(channel, -size, -1)
+	if !meta.isEmpty() {
+		_, err = svc.meta.remove(channel, name, nil, nil)
+		if err != nil {
+			log.error("Fail to delete file metadata", "file", name, "err", err)
+		}
+	}
+	return size, nil
+}
+
+// Returns the names of the channels, skipping the hidden files of the FS root,
+// like the metadata of the channels.
 func readChannels() ([]string, error) {
 	root, err := getFsRootFile()
 	if err != nil {
 		return nil, err
 	}
-	channels, err := files.ReadFileNames(root)
+	names, err := files.ReadFileNames(root)
 	if err != nil {
 		return nil, err
 	}
+	channels := make([]string, 0, len(names))
+	for _, name := range names {
+		if !strings.HasPrefix(name, ".") {
+			channels = append(channels, name)
+		}
+	}
 	return channels, nil
 }
 
@@ -195,7 +1153,10 @@ func readFiles(channel process.Channel) ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
-	dir, _ := channel.File()
+	dir, err := channel.File()
+	if err != nil || channel.Name == "" {
+		return nil, errors.New("invalid channel")
+	}
 	channelFile := dir.ToOsFile(root.Path())
 	fileList, err := files.ReadFileNames(channelFile)
 	if err != nil {
@@ -203,3 +1164,43 @@ func readFiles(channel process.Channel) ([]string, error) {
 	}
 	return fileList, nil
 }
+
+// Returns the stat of the file of the channel with the given metadata.
+func statFile(svc *services, channel process.Channel, name string, meta FileMeta) (FileStat, error) {
+	file, err := channel.File()
+	if err != nil || channel.Name == "" {
+		return FileStat{}, errors.New("invalid channel")
+	}
+	err = file.Append(name)
+	if err != nil || name == "" {
+		return FileStat{}, errors.New("invalid file")
+	}
+	info, err := os.Stat(file.ToOsFile(svc.osFsRoot).Path())
+	if err != nil || info.IsDir() {
+		return FileStat{}, errors.New("file not found")
+	}
+	return FileStat{
+		Channel:  channel.Name,
+		Name:     name,
+		Size:     uint64(info.Size()),
+		ModTime:  info.ModTime(),
+		FileMeta: meta,
+	}, nil
+}
+
+// Returns the stats of the files of the channel with their metadata.
+func readFileStats(svc *services, channel process.Channel, names []string) ([]FileStat, error) {
+	index, err := svc.meta.getAll(channel)
+	if err != nil {
+		return nil, err
+	}
+	stats := make([]FileStat, 0, len(names))
+	for _, name := range names {
+		stat, err := statFile(svc, channel, name, index[name])
+		if err != nil {
+			continue // Deleted meanwhile
+		}
+		stats = append(stats, stat)
+	}
+	return stats, nil
+}
@@ -88,12 +88,20 @@ func TestCommandListOfClients(t *testing.T) {
 	}
 
 	// Check
-	var users []string
+	var users []ClientInfo
 	err = json.Unmarshal([]byte(res.Command["PAYLOAD"]), &users)
 
 	if err != nil {
 		t.Fatal("Fail to read payload")
 	}
+	if len(users) == 0 {
+		t.Fatal("Connected users must contain this client")
+	}
+	for _, user := range users {
+		if user.Address == "" || user.Connected.IsZero() {
+			t.Fatal("Connected user details missing:", user)
+		}
+	}
 
 	// Check
 	log.Println("Connected users:", users)
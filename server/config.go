@@ -0,0 +1,166 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"flag"
+	"os"
+	"time"
+)
+
+// config Defines the server settings that can be given when starting it.
+type config struct {
+	adminToken     string // Token required by the ADMIN command, empty disables it
+	connectionRate int64  // Bytes per second of each connection, 0 is unlimited
+	channelRate    int64  // Bytes per second of each channel, 0 is unlimited
+	globalRate     int64  // Bytes per second of the server, 0 is unlimited
+
+	maxClients      int   // Max concurrent clients, 0 is unlimited
+	maxClientsPerIp int   // Max concurrent clients of the same IP, 0 is unlimited
+	acceptRate      int64 // New connections per second, 0 is unlimited
+
+	logLevel  string // One of debug, info, warn or error
+	logFormat string // One of text or json
+
+	metricsAddr string // Address of the HTTP metrics endpoint, empty disables it
+	adminAddr   string // Address of the HTTP admin API, empty disables it
+	wsAddr      string // Address of the WebSocket gateway, empty disables it
+	wsOrigins   string // Comma separated origins allowed besides the same host
+
+	eventLogSize    int           // Max number of change events kept for catching up
+	chatHistorySize int           // Max number of messages kept per channel
+	maxVersions     int           // Max number of previous versions kept per file
+	trashRetention  time.Duration // How long deleted items are kept, 0 is forever
+	dedup           bool          // Whether to store the same content only once
+
+	webhookUrls   string // Comma separated URLs to POST the events to
+	webhookSecret string // Key to sign the webhook requests, empty doesn't sign
+}
+
+func loadConfig() config {
+	cfg := config{}
+	flag.StringVar(
+		&cfg.adminToken,
+		"admin-token",
+		os.Getenv("FS_ADMIN_TOKEN"),
+		"token that clients send to get admin privileges",
+	)
+	flag.Int64Var(
+		&cfg.connectionRate,
+		"rate-connection",
+		0,
+		"max bytes per second of DATA and STREAM for each connection",
+	)
+	flag.Int64Var(
+		&cfg.channelRate,
+		"rate-channel",
+		0,
+		"max bytes per second of DATA and STREAM for each channel",
+	)
+	flag.Int64Var(
+		&cfg.globalRate,
+		"rate-global",
+		0,
+		"max bytes per second of DATA and STREAM for the whole server",
+	)
+	flag.IntVar(
+		&cfg.maxClients,
+		"max-clients",
+		0,
+		"max number of concurrent clients",
+	)
+	flag.IntVar(
+		&cfg.maxClientsPerIp,
+		"max-clients-per-ip",
+		0,
+		"max number of concurrent clients from the same IP",
+	)
+	flag.Int64Var(
+		&cfg.acceptRate,
+		"accept-rate",
+		0,
+		"max number of new connections accepted per second",
+	)
+	flag.StringVar(
+		&cfg.logLevel,
+		"log-level",
+		"info",
+		"min level of the log lines: debug, info, warn or error",
+	)
+	flag.StringVar(
+		&cfg.logFormat,
+		"log-format",
+		string(formatText),
+		"format of the log lines: text or json",
+	)
+	flag.StringVar(
+		&cfg.metricsAddr,
+		"metrics-addr",
+		"",
+		"address to serve the Prometheus metrics on, e.g. :9090",
+	)
+	flag.StringVar(
+		&cfg.adminAddr,
+		"admin-addr",
+		"",
+		"address to serve the admin HTTP API on, e.g. :8082",
+	)
+	flag.StringVar(
+		&cfg.wsAddr,
+		"ws-addr",
+		"",
+		"address to serve the WebSocket gateway on, e.g. :8081",
+	)
+	flag.StringVar(
+		&cfg.wsOrigins,
+		"ws-origins",
+		"",
+		"comma separated origins allowed to use the WebSocket gateway besides its host, * allows any",
+	)
+	flag.IntVar(
+		&cfg.eventLogSize,
+		"event-log-size",
+		1000,
+		"max number of change events kept for clients to catch up",
+	)
+	flag.IntVar(
+		&cfg.chatHistorySize,
+		"chat-history-size",
+		200,
+		"max number of messages kept per channel",
+	)
+	flag.IntVar(
+		&cfg.maxVersions,
+		"max-versions",
+		10,
+		"max number of previous versions kept per file, 0 to keep none",
+	)
+	flag.DurationVar(
+		&cfg.trashRetention,
+		"trash-retention",
+		7*24*time.Hour,
+		"how long deleted channels and files are kept in the trash, 0 to keep them",
+	)
+	flag.BoolVar(
+		&cfg.dedup,
+		"dedup",
+		false,
+		"store the content of the files uploaded only once, keyed by its SHA-256",
+	)
+	flag.StringVar(
+		&cfg.webhookUrls,
+		"webhook-url",
+		"",
+		"comma separated URLs to send the file events to",
+	)
+	flag.StringVar(
+		&cfg.webhookSecret,
+		"webhook-secret",
+		os.Getenv("FS_WEBHOOK_SECRET"),
+		"secret to sign the webhook requests with HMAC-SHA256",
+	)
+	flag.Parse()
+	return cfg
+}
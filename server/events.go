@@ -0,0 +1,114 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"encoding/json"
+	"fs"
+	"sync"
+)
+
+const (
+	eventsFile          = "events.log"
+	eventsMinCompaction = 100 // Min lines of the log file to compact it
+)
+
+// CatchUpPayload Sent to the CATCH_UP command with the changes that happened
+// after the sequence number given. If the log doesn't reach back that far,
+// Resync is true and the client has to list everything again.
+type CatchUpPayload struct {
+	Seq    uint64 // Sequence number of the last change
+	Resync bool
+	Events []UpdatePayload
+}
+
+// eventLog Keeps the last change events of the FS, each with a sequence
+// number that always increases, even after a restart, so clients can replay
+// the ones they missed. Each event is appended to a file in the data root,
+// which is compacted into the events kept once it doubles their number.
+type eventLog struct {
+	mu      sync.Mutex
+	journal *journal
+	size    int // Max number of events kept
+	Seq     uint64
+	Events  []UpdatePayload
+}
+
+func loadEventLog(osDataRoot string, size int) (*eventLog, error) {
+	l := &eventLog{
+		size:   size,
+		Events: make([]UpdatePayload, 0),
+	}
+	j, err := openJournal(osDataRoot+fs.Separator+eventsFile, func(line []byte) {
+		var u UpdatePayload
+		if json.Unmarshal(line, &u) != nil {
+			return // Skip a line that was partially written
+		}
+		if u.Seq > l.Seq {
+			l.Seq = u.Seq
+		}
+		// A line that is not a change only keeps the sequence number
+		if u.Change {
+			l.keep(u)
+		}
+	})
+	l.journal = j
+	return l, err
+}
+
+// Gives the next sequence number to the event and keeps it, dropping the
+// oldest event if the log is full.
+func (l *eventLog) append(u UpdatePayload) (UpdatePayload, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.Seq++
+	u.Seq = l.Seq
+	l.keep(u)
+	if err := l.journal.write(u); err != nil {
+		return u, err
+	}
+	if l.journal.lines < 2*l.size || l.journal.lines < eventsMinCompaction {
+		return u, nil
+	}
+	records := make([]any, 0, len(l.Events))
+	for _, e := range l.Events {
+		records = append(records, e)
+	}
+	if len(records) == 0 {
+		records = append(records, UpdatePayload{Seq: l.Seq})
+	}
+	return u, l.journal.compact(records)
+}
+
+func (l *eventLog) keep(u UpdatePayload) {
+	l.Events = append(l.Events, u)
+	if len(l.Events) > l.size {
+		l.Events = append(l.Events[:0], l.Events[len(l.Events)-l.size:]...)
+	}
+}
+
+// Returns the events after the given sequence number, only of the channel if
+// it's not empty.
+func (l *eventLog) since(seq uint64, channel string) CatchUpPayload {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	payload := CatchUpPayload{Seq: l.Seq, Events: make([]UpdatePayload, 0)}
+
+	// The next event the client expects must still be in the log
+	oldest := l.Seq + 1
+	if len(l.Events) > 0 {
+		oldest = l.Events[0].Seq
+	}
+	if seq > l.Seq || seq+1 < oldest {
+		payload.Resync = true
+		return payload
+	}
+	for _, u := range l.Events {
+		if u.Seq > seq && (channel == "" || u.Channel == channel) {
+			payload.Events = append(payload.Events, u)
+		}
+	}
+	return payload
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"fs/utils"
+	"testing"
+)
+
+func TestEventLog(t *testing.T) {
+	dir := t.TempDir()
+	events, err := loadEventLog(dir, 3)
+	utils.RequirePassCase(t, err, "Fail to load event log")
+
+	for i := 0; i < 4; i++ {
+		channel := "test"
+		if i%2 == 1 {
+			channel = "main"
+		}
+		u, err := events.append(newChange(ChangeFileAdded, channel, "file.txt", 1))
+		utils.RequirePassCase(t, err, "Fail to append event")
+		if u.Seq != uint64(i+1) {
+			t.Fatal("Wrong sequence number:", u.Seq)
+		}
+	}
+
+	// Events 2, 3 and 4 are kept
+	payload := events.since(1, "")
+	if payload.Resync || len(payload.Events) != 3 || payload.Seq != 4 {
+		t.Fatal("Wrong events since 1:", payload)
+	}
+	payload = events.since(2, "main")
+	if len(payload.Events) != 1 || payload.Events[0].Seq != 4 {
+		t.Fatal("Wrong events of the channel:", payload)
+	}
+	if !events.since(0, "").Resync {
+		t.Fatal("Resync required when the log doesn't reach back")
+	}
+	if !events.since(5, "").Resync {
+		t.Fatal("Resync required for an unknown sequence number")
+	}
+
+	// The sequence continues after a restart
+	events, err = loadEventLog(dir, 3)
+	utils.RequirePassCase(t, err, "Fail to reload event log")
+	u, _ := events.append(newChange(ChangeFileDeleted, "test", "file.txt", 1))
+	if u.Seq != 5 || len(events.since(4, "").Events) != 1 {
+		t.Fatal("Event log not persisted")
+	}
+}
+
+func TestEventLogCompaction(t *testing.T) {
+	for _, size := range []int{0, 3} {
+		dir := t.TempDir()
+		events, err := loadEventLog(dir, size)
+		utils.RequirePassCase(t, err, "Fail to load event log")
+		for i := 0; i < 3*eventsMinCompaction; i++ {
+			_, err = events.append(newChange(ChangeFileAdded, "test", "file.txt", 1))
+			utils.RequirePassCase(t, err, "Fail to append event")
+		}
+		if events.journal.lines >= eventsMinCompaction {
+			t.Fatal("Event log file not compacted:", events.journal.lines)
+		}
+
+		events, err = loadEventLog(dir, size)
+		utils.RequirePassCase(t, err, "Fail to reload event log")
+		if events.Seq != 3*eventsMinCompaction || len(events.Events) != size {
+			t.Fatal("Compacted event log not persisted:", events.Seq, len(events.Events))
+		}
+	}
+}
@@ -5,9 +5,10 @@
 package main
 
 import (
-	"encoding/json"
-	"log"
-	"strconv"
+	"errors"
+	"fs"
+	"strings"
+	"sync/atomic"
 )
 
 type Hub struct {
@@ -15,22 +16,53 @@ type Hub struct {
 	register        chan *Client
 	unregister      chan *Client
 	quit            chan struct{}
-	change          chan struct{} // Rudimentary signal to test broadcast
-	list            chan *Client  // Signal to send the list of connected clients
-	cid             uint          // Current ID for clients on this server instance
-	clientHubChange chan struct{} // When a client regs or unregs
+	change          chan UpdatePayload  // Signals a change of the FS
+	list            chan *Client        // Signal to send the list of connected clients
+	cid             uint64              // Next ID for clients on this server instance
+	clientHubChange chan struct{}       // When a client regs or unregs
+	inspect         chan chan []*Client // Requests the connected clients
+	kick            chan kickRequest
+	observe         chan observeRequest
+	activity        chan ProgressPayload        // Progress events of the transfers
+	observers       map[string]map[uint]*Client // Clients observing each channel
+	subscribers     map[string]map[uint]*Client // Clients subscribed to each channel
+	subscription    chan subscriptionRequest
+	watchers        map[string]map[uint]*Client // Clients watching each file
+	watch           chan watchRequest
+	global          map[uint]*Client // Clients receiving the updates of all channels
+	setGlobal       chan globalRequest
+	presence        chan PresencePayload
+	chat            chan ChatPayload
+	events          *eventLog
+	log             logger
+	metrics         *metrics
 }
 
-func NewHub() *Hub {
+func NewHub(log logger, metrics *metrics, events *eventLog) *Hub {
 	return &Hub{
 		clients:         make(map[uint]*Client),
 		register:        make(chan *Client),
 		unregister:      make(chan *Client),
 		quit:            make(chan struct{}),
-		change:          make(chan struct{}),
+		change:          make(chan UpdatePayload),
 		list:            make(chan *Client),
-		cid:             0,
 		clientHubChange: make(chan struct{}),
+		inspect:         make(chan chan []*Client),
+		kick:            make(chan kickRequest),
+		observe:         make(chan observeRequest),
+		activity:        make(chan ProgressPayload),
+		observers:       make(map[string]map[uint]*Client),
+		subscribers:     make(map[string]map[uint]*Client),
+		subscription:    make(chan subscriptionRequest),
+		watchers:        make(map[string]map[uint]*Client),
+		watch:           make(chan watchRequest),
+		global:          make(map[uint]*Client),
+		setGlobal:       make(chan globalRequest),
+		presence:        make(chan PresencePayload),
+		chat:            make(chan ChatPayload),
+		events:          events,
+		log:             log,
+		metrics:         metrics,
 	}
 }
 
@@ -41,10 +73,30 @@ func (h *Hub) run() {
 			h.registerClient(c)
 		case c := <-h.unregister:
 			h.unregisterClient(c)
-		case <-h.change:
-			go h.broadcastChange()
+		case u := <-h.change:
+			u = h.recordChange(u)
+			h.broadcastChange(u)
+			h.notifyWatchers(u)
 		case c := <-h.list:
-			go h.listClients(c)
+			h.listClients(c)
+		case reply := <-h.inspect:
+			reply <- h.clientList()
+		case k := <-h.kick:
+			h.kickClient(k)
+		case s := <-h.subscription:
+			h.subscribeChannel(s)
+		case w := <-h.watch:
+			indexClient(h.watchers, w.file, w.client, w.watch)
+		case o := <-h.observe:
+			h.observeChannel(o)
+		case p := <-h.activity:
+			h.broadcastProgress(p)
+		case g := <-h.setGlobal:
+			h.setGlobalUpdates(g)
+		case p := <-h.presence:
+			h.broadcastPresence(p)
+		case m := <-h.chat:
+			h.broadcastChat(m)
 		case <-h.quit:
 			h.unregisterAll()
 			return
@@ -52,15 +104,20 @@ func (h *Hub) run() {
 	}
 }
 
+// Returns the ID for a new client. It's given before the client is registered,
+// so the hooks can identify it before it's accepted.
+func (h *Hub) nextCid() uint {
+	return uint(atomic.AddUint64(&h.cid, 1) - 1)
+}
+
 func (h *Hub) registerClient(client *Client) {
-	id := h.cid
-	client.id = id
+	id := client.id
 	h.clients[id] = client
-	h.cid++
+	h.metrics.setConnectedClients(len(h.clients))
 	go func() {
 		h.clientHubChange <- struct{}{}
 	}()
-	log.Println("Registering client", id, "into the Hub")
+	h.log.info("Registering client into the Hub", "cid", id)
 }
 
 func (h *Hub) unregisterAll() {
@@ -71,27 +128,232 @@ func (h *Hub) unregisterAll() {
 
 func (h *Hub) unregisterClient(c *Client) {
 	delete(h.clients, c.id)
+	delete(h.global, c.id)
+	for channel := range h.observers {
+		indexClient(h.observers, channel, c, false)
+	}
+	for file := range h.watchers {
+		indexClient(h.watchers, file, c, false)
+	}
+	for channel, subscribers := range h.subscribers {
+		if _, ok := subscribers[c.id]; !ok {
+			continue
+		}
+		indexClient(h.subscribers, channel, c, false)
+		h.broadcastPresence(PresencePayload{
+			Event:   PresenceLeft,
+			CID:     c.id,
+			Channel: channel,
+			Profile: c.state.status.readProfile(),
+		})
+	}
+	h.metrics.setConnectedClients(len(h.clients))
 	go func() {
 		h.clientHubChange <- struct{}{}
 	}()
-	log.Println("Unregistering client", c.id, "from the Hub")
+	h.log.info("Unregistering client from the Hub", "cid", c.id)
 }
 
-func (h *Hub) broadcastChange() {
-	payload := UpdatePayload{Change: true}
-	for _, client := range h.clients {
-		client.notify <- payload
+// Gives the sequence number to the change and keeps it in the event log, so
+// clients can catch up after reconnecting.
+func (h *Hub) recordChange(u UpdatePayload) UpdatePayload {
+	u, err := h.events.append(u)
+	if err != nil {
+		h.log.error("Fail to save event log", "seq", u.Seq, "err", err)
+	}
+	return u
+}
+
+// Returns the clients subscribed to the channel, and the ones receiving the
+// updates of all channels.
+func (h *Hub) changeRecipients(channel string) []*Client {
+	list := make([]*Client, 0, len(h.subscribers[channel])+len(h.global))
+	for _, client := range h.subscribers[channel] {
+		list = append(list, client)
+	}
+	for cid, client := range h.global {
+		if _, ok := h.subscribers[channel][cid]; !ok {
+			list = append(list, client)
+		}
+	}
+	return list
+}
+
+// Pushes the change to its recipients from the Hub goroutine, so every client
+// gets the changes in the order of their sequence numbers.
+func (h *Hub) broadcastChange(u UpdatePayload) {
+	for _, client := range h.changeRecipients(u.Channel) {
+		client.sendUpdate(u)
 	}
 }
 
 func (h *Hub) listClients(c *Client) {
-	var list []string
+	list := make([]ClientInfo, 0, len(h.clients))
 	for _, client := range h.clients {
-		item := make(map[string]string)
-		item["cid"] = strconv.Itoa(int(client.id))
-		item["channel"] = client.channel().Name
-		ser, _ := json.Marshal(item)
-		list = append(list, string(ser))
+		list = append(list, client.info())
 	}
 	c.sendList(list)
 }
+
+// Returns the clients connected to the Hub. It's safe to call it from other
+// goroutines.
+func (h *Hub) requestClients() []*Client {
+	reply := make(chan []*Client, 1)
+	h.inspect <- reply
+	return <-reply
+}
+
+// Disconnects the client with the given ID after sending it the reason. It's
+// safe to call it from other goroutines.
+func (h *Hub) requestKick(cid uint, reason string) error {
+	done := make(chan error, 1)
+	h.kick <- kickRequest{cid: cid, reason: reason, done: done}
+	return <-done
+}
+
+func (h *Hub) clientList() []*Client {
+	list := make([]*Client, 0, len(h.clients))
+	for _, client := range h.clients {
+		list = append(list, client)
+	}
+	return list
+}
+
+type kickRequest struct {
+	cid    uint
+	reason string
+	done   chan error
+}
+
+func (h *Hub) kickClient(k kickRequest) {
+	client, ok := h.clients[k.cid]
+	if !ok {
+		k.done <- errors.New("client not found")
+		return
+	}
+	h.log.info("Kicking client", "cid", k.cid, "reason", k.reason)
+	go client.kick(k.reason)
+	k.done <- nil
+}
+
+func (h *Hub) observeChannel(o observeRequest) {
+	indexClient(h.observers, o.channel, o.client, o.observe)
+}
+
+type subscriptionRequest struct {
+	client    *Client
+	channel   string
+	subscribe bool
+	profile   Profile // Sent to the other clients of the channel
+}
+
+// Adds or removes the client from the subscribers of the channel, and tells
+// the other subscribers that it joined or left.
+func (h *Hub) subscribeChannel(s subscriptionRequest) {
+	indexClient(h.subscribers, s.channel, s.client, s.subscribe)
+	event := PresenceJoined
+	if !s.subscribe {
+		event = PresenceLeft
+	}
+	h.broadcastPresence(PresencePayload{
+		Event:   event,
+		CID:     s.client.id,
+		Channel: s.channel,
+		Profile: s.profile,
+	})
+}
+
+// Adds or removes the client from the clients of the channel in the index,
+// removing the channel when it has no clients left.
+func indexClient(index map[string]map[uint]*Client, channel string, c *Client, add bool) {
+	clients, ok := index[channel]
+	if !add {
+		delete(clients, c.id)
+		if ok && len(clients) == 0 {
+			delete(index, channel)
+		}
+		return
+	}
+	if !ok {
+		clients = make(map[uint]*Client)
+		index[channel] = clients
+	}
+	clients[c.id] = c
+}
+
+// Sends the progress event to the clients observing its channel, except to the
+// client doing the transfer. It's pushed with low priority, so it's dropped for
+// the observers that are not keeping up, and it never blocks the Hub.
+func (h *Hub) broadcastProgress(p ProgressPayload) {
+	for cid, client := range h.observers[p.Channel] {
+		if cid == p.CID {
+			continue
+		}
+		client.sendProgress(p)
+	}
+}
+
+type watchRequest struct {
+	client *Client
+	file   string // Path of the file, including its channel
+	watch  bool
+}
+
+// Pushes the change to the clients watching the file, or every file of the
+// channel if it was deleted.
+func (h *Hub) notifyWatchers(u UpdatePayload) {
+	switch u.Type {
+	case ChangeFileAdded, ChangeFileReplaced, ChangeFileDeleted:
+		file := watchKey(u.Channel, u.Path)
+		for _, client := range h.watchers[file] {
+			client.push(FileChange, newWatchPayload(u, u.Path), priorityNormal)
+		}
+	case ChangeChannelDeleted:
+		prefix := watchKey(u.Channel, "")
+		for file, clients := range h.watchers {
+			if !strings.HasPrefix(file, prefix) {
+				continue
+			}
+			p := newWatchPayload(u, strings.TrimPrefix(file, prefix))
+			for _, client := range clients {
+				client.push(FileChange, p, priorityNormal)
+			}
+		}
+	}
+}
+
+// Returns the path of the file in the FS, used to index its watchers.
+func watchKey(channel string, path string) string {
+	return channel + fs.Separator + path
+}
+
+type globalRequest struct {
+	client *Client
+	global bool
+}
+
+func (h *Hub) setGlobalUpdates(g globalRequest) {
+	if g.global {
+		h.global[g.client.id] = g.client
+	} else {
+		delete(h.global, g.client.id)
+	}
+}
+
+// Sends the presence change to the other clients of its channel.
+func (h *Hub) broadcastPresence(p PresencePayload) {
+	for cid, client := range h.subscribers[p.Channel] {
+		if cid != p.CID {
+			client.sendPresence(p)
+		}
+	}
+}
+
+// Relays the message to the other clients of its channel.
+func (h *Hub) broadcastChat(m ChatPayload) {
+	for cid, client := range h.subscribers[m.Channel] {
+		if cid != m.CID {
+			client.push(Chat, m, priorityNormal)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"encoding/json"
+	"fs/utils"
+	"testing"
+)
+
+func TestHubChangeRecipients(t *testing.T) {
+	hub := NewHub(logger{}, newMetrics(), nil)
+	test := &Client{id: 1}
+	main := &Client{id: 2}
+	admin := &Client{id: 3}
+	hub.clients = map[uint]*Client{1: test, 2: main, 3: admin}
+	hub.subscribeChannel(subscriptionRequest{client: test, channel: "test", subscribe: true})
+	hub.subscribeChannel(subscriptionRequest{client: main, channel: "main", subscribe: true})
+
+	recipients := hub.changeRecipients("test")
+	if len(recipients) != 1 || recipients[0] != test {
+		t.Fatal("Change must only be sent to the channel clients")
+	}
+
+	hub.setGlobalUpdates(globalRequest{client: admin, global: true})
+	recipients = hub.changeRecipients("test")
+	if len(recipients) != 2 {
+		t.Fatal("Change must also be sent to the global clients")
+	}
+
+	hub.setGlobalUpdates(globalRequest{client: admin, global: false})
+	recipients = hub.changeRecipients("main")
+	if len(recipients) != 1 || recipients[0] != main {
+		t.Fatal("Change sent after unsubscribing from global updates")
+	}
+}
+
+func TestHubBroadcastChangeInOrder(t *testing.T) {
+	hub := NewHub(logger{}, newMetrics(), nil)
+	client := &Client{id: 1, out: newOutbox(nil, outboxSize, nil)}
+	indexClient(hub.subscribers, "test", client, true)
+
+	for seq := uint64(1); seq <= 10; seq++ {
+		u := newChange(ChangeFileAdded, "test", "doc.txt", 10)
+		u.Seq = seq
+		hub.broadcastChange(u)
+	}
+	if len(client.out.pushes) != 10 {
+		t.Fatal("Changes not pushed to the subscriber")
+	}
+	for i, item := range client.out.pushes {
+		msg := Message{}
+		utils.RequirePassCase(t, json.Unmarshal(item.data, &msg), "Fail to read push")
+		u, err := msg.UpdatePayload()
+		utils.RequirePassCase(t, err, "Fail to read update")
+		if u.Seq != uint64(i+1) {
+			t.Fatalf("Expected change with seq %v, got %v", i+1, u.Seq)
+		}
+	}
+}
+
+func TestHubSubscriptions(t *testing.T) {
+	hub := NewHub(logger{}, newMetrics(), nil)
+	client := &Client{id: 1, out: newOutbox(nil, outboxSize, nil)}
+	other := &Client{id: 2, out: newOutbox(nil, outboxSize, nil)}
+	hub.subscribeChannel(subscriptionRequest{client: other, channel: "main", subscribe: true})
+	hub.subscribeChannel(subscriptionRequest{client: client, channel: "test", subscribe: true})
+	hub.subscribeChannel(subscriptionRequest{client: client, channel: "main", subscribe: true})
+
+	if len(other.out.pushes) != 1 {
+		t.Fatal("Subscribers not told about the client joining")
+	}
+	if len(hub.changeRecipients("test")) != 1 || len(hub.changeRecipients("main")) != 2 {
+		t.Fatal("Change must be sent to every channel subscribed")
+	}
+
+	hub.subscribeChannel(subscriptionRequest{client: client, channel: "test", subscribe: false})
+	if len(hub.changeRecipients("test")) != 0 {
+		t.Fatal("Change sent after unsubscribing")
+	}
+	if _, ok := hub.subscribers["test"]; ok {
+		t.Fatal("Channel without subscribers kept in the index")
+	}
+	if len(hub.changeRecipients("main")) != 2 {
+		t.Fatal("Other subscriptions must be kept")
+	}
+}
+
+func TestHubNotifyWatchers(t *testing.T) {
+	hub := NewHub(logger{}, newMetrics(), nil)
+	client := &Client{id: 1, out: newOutbox(nil, outboxSize, nil)}
+	indexClient(hub.watchers, watchKey("test", "doc.txt"), client, true)
+
+	hub.notifyWatchers(newChange(ChangeFileAdded, "test", "other.txt", 10))
+	hub.notifyWatchers(newChange(ChangeFileAdded, "main", "doc.txt", 10))
+	if len(client.out.pushes) != 0 {
+		t.Fatal("Change of another file pushed")
+	}
+
+	hub.notifyWatchers(newChange(ChangeFileReplaced, "test", "doc.txt", 10))
+	hub.notifyWatchers(newChange(ChangeChannelDeleted, "test", "", 0))
+	if len(client.out.pushes) != 2 {
+		t.Fatal("Changes of the watched file not pushed")
+	}
+
+	p := newWatchPayload(newChange(ChangeChannelDeleted, "test", "", 0), "doc.txt")
+	if p.Event != ChangeFileDeleted || p.Path != "doc.txt" || p.ModTime.IsZero() {
+		t.Fatal("Deleting the channel must delete the watched file:", p)
+	}
+
+	indexClient(hub.watchers, watchKey("test", "doc.txt"), client, false)
+	hub.notifyWatchers(newChange(ChangeFileDeleted, "test", "doc.txt", 10))
+	if len(client.out.pushes) != 2 {
+		t.Fatal("Change pushed after unwatching the file")
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"encoding/json"
 	"fs"
 	"fs/process"
+	"time"
 )
 
 type Message struct {
@@ -53,6 +54,30 @@ func (p Payload) UpdatePayload() (UpdatePayload, error) {
 	return payload, err
 }
 
+func (p Payload) ProgressPayload() (ProgressPayload, error) {
+	payload := ProgressPayload{}
+	err := json.Unmarshal(p.Data, &payload)
+	return payload, err
+}
+
+func (p Payload) PresencePayload() (PresencePayload, error) {
+	payload := PresencePayload{}
+	err := json.Unmarshal(p.Data, &payload)
+	return payload, err
+}
+
+func (p Payload) ChatPayload() (ChatPayload, error) {
+	payload := ChatPayload{}
+	err := json.Unmarshal(p.Data, &payload)
+	return payload, err
+}
+
+func (p Payload) QuitPayload() (QuitPayload, error) {
+	payload := QuitPayload{}
+	err := json.Unmarshal(p.Data, &payload)
+	return payload, err
+}
+
 func (p Payload) ErrorPayload() (ErrorPayload, error) {
 	payload := ErrorPayload{}
 	err := json.Unmarshal(p.Data, &payload)
@@ -63,10 +88,136 @@ type StreamPayload struct {
 	fs.FileInfo
 }
 
+type ChangeType string
+
+const (
+	ChangeFileAdded      ChangeType = "FILE_ADDED"
+	ChangeFileReplaced   ChangeType = "FILE_REPLACED"
+	ChangeFileDeleted    ChangeType = "FILE_DELETED"
+	ChangeChannelCreated ChangeType = "CHANNEL_CREATED"
+	ChangeChannelDeleted ChangeType = "CHANNEL_DELETED"
+)
+
+// UpdatePayload Describes a change of the FS, so clients can update their
+// lists without reloading them. The path and size are only set for the file
+// changes, and the modification time for the files added or replaced.
 type UpdatePayload struct {
-	Change bool // Rudimentary signal to test broadcast
+	Change  bool   // Always true, for the clients that only read the signal
+	Seq     uint64 // Sequence number given by the Hub
+	Type    ChangeType
+	Channel string
+	Path    string `json:",omitempty"`
+	Size    uint64 `json:",omitempty"`
+	ModTime time.Time
+	CID     uint   // Client that made the change
+	User    string `json:",omitempty"` // Set instead of the CID, e.g. "admin-api"
+	Time    time.Time
+	Resync  bool `json:",omitempty"` // Set alone when updates were dropped
+}
+
+func newChange(t ChangeType, channel string, path string, size uint64) UpdatePayload {
+	return UpdatePayload{
+		Change:  true,
+		Type:    t,
+		Channel: channel,
+		Path:    path,
+		Size:    size,
+		Time:    time.Now(),
+	}
 }
 
 type ErrorPayload struct {
 	Message string
 }
+
+// QuitPayload Sent with the Quit response when the server closes the client
+// connection.
+type QuitPayload struct {
+	Reason string
+}
+
+type ProgressEvent string
+
+const (
+	ProgressStarted   ProgressEvent = "STARTED"
+	ProgressPercent   ProgressEvent = "PERCENT"
+	ProgressCompleted ProgressEvent = "COMPLETED"
+	ProgressFailed    ProgressEvent = "FAILED"
+)
+
+// ProgressPayload Sent with the Progress response to the clients observing the
+// activity of a channel, for each upload or download of another client.
+type ProgressPayload struct {
+	Event    ProgressEvent
+	Transfer uint64 // ID of the transfer
+	CID      uint
+	Action   string
+	Channel  string
+	File     string
+	Size     uint64
+	Bytes    uint64
+	Percent  int
+	Error    string `json:",omitempty"`
+}
+
+type PresenceEvent string
+
+const (
+	PresenceJoined  PresenceEvent = "JOINED"
+	PresenceLeft    PresenceEvent = "LEFT"
+	PresenceUpdated PresenceEvent = "UPDATED"
+)
+
+// PresencePayload Sent with the Presence response to the clients of a channel
+// when another client joins it, leaves it, or changes its profile.
+type PresencePayload struct {
+	Event   PresenceEvent
+	CID     uint
+	Channel string
+	Profile Profile
+}
+
+// ChatPayload A text message sent to a channel with the MESSAGE command. It's
+// relayed with the Chat response to the clients of the channel.
+type ChatPayload struct {
+	ID      uint64 // Sequence number of the message in its channel
+	Channel string
+	CID     uint
+	Name    string // Profile name of the sender, if any
+	Text    string
+	Time    time.Time
+}
+
+// WatchPayload Sent with the FileChange response to the clients watching the
+// file when it's added, replaced or deleted.
+type WatchPayload struct {
+	Event   ChangeType
+	Seq     uint64 // Sequence number of the change
+	Channel string
+	Path    string
+	Size    uint64 // Size of the file after the change, 0 if it was deleted
+	ModTime time.Time
+	CID     uint   // Client that made the change
+	User    string `json:",omitempty"`
+}
+
+// Returns the event of the watched file for the change, which is deleted
+// along with its channel.
+func newWatchPayload(u UpdatePayload, path string) WatchPayload {
+	p := WatchPayload{
+		Event:   u.Type,
+		Seq:     u.Seq,
+		Channel: u.Channel,
+		Path:    path,
+		Size:    u.Size,
+		ModTime: u.ModTime,
+		CID:     u.CID,
+		User:    u.User,
+	}
+	if u.Type == ChangeFileDeleted || u.Type == ChangeChannelDeleted {
+		p.Event = ChangeFileDeleted
+		p.Size = 0
+		p.ModTime = u.Time
+	}
+	return p
+}
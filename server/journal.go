@@ -0,0 +1,110 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+)
+
+// journal Persists a state as JSON lines appended to a file, so each change is
+// written without rewriting the whole state. Once it has grown enough, it's
+// compacted into the lines of the live state only. It must be guarded by the
+// lock of its owner.
+type journal struct {
+	path  string
+	file  *os.File
+	lines int // Lines in the file, to tell when to compact it
+}
+
+// Opens the journal at the given path, passing each line already written to
+// read. A line that was partially written is passed as well, so read has to
+// skip the lines it can't decode.
+func openJournal(path string, read func(line []byte)) (*journal, error) {
+	j := &journal{path: path}
+	if err := j.read(read); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	j.file = f
+	return j, nil
+}
+
+func (j *journal) read(read func(line []byte)) error {
+	f, err := os.Open(j.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		read(scanner.Bytes())
+		j.lines++
+	}
+	return scanner.Err()
+}
+
+func (j *journal) write(v any) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err = j.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	j.lines++
+	return nil
+}
+
+// Replaces the file with the given records, which must be the live state. The
+// new file is written aside and renamed, so a crash keeps the previous one.
+func (j *journal) compact(records []any) error {
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, r := range records {
+		if err = enc.Encode(r); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, j.path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	file, err := os.OpenFile(j.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_ = j.file.Close()
+	j.file = file
+	j.lines = len(records)
+	return nil
+}
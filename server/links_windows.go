@@ -0,0 +1,38 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+//go:build windows
+
+package main
+
+import (
+	"syscall"
+)
+
+// Returns the number of hard links to the file at the path.
+func linkCount(path string) (uint64, error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	handle, err := syscall.CreateFile(
+		name,
+		0,
+		syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE,
+		nil,
+		syscall.OPEN_EXISTING,
+		syscall.FILE_FLAG_BACKUP_SEMANTICS,
+		0,
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer syscall.CloseHandle(handle)
+	var info syscall.ByHandleFileInformation
+	err = syscall.GetFileInformationByHandle(handle, &info)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(info.NumberOfLinks), nil
+}
@@ -0,0 +1,201 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelStrings = map[logLevel]string{
+	levelDebug: "DEBUG",
+	levelInfo:  "INFO",
+	levelWarn:  "WARN",
+	levelError: "ERROR",
+}
+
+func (l logLevel) String() string {
+	return logLevelStrings[l]
+}
+
+func parseLogLevel(value string) (logLevel, error) {
+	for level, str := range logLevelStrings {
+		if strings.EqualFold(str, value) {
+			return level, nil
+		}
+	}
+	return levelInfo, errors.New("invalid log level: " + value)
+}
+
+type logFormat string
+
+const (
+	formatText logFormat = "text"
+	formatJson logFormat = "json"
+)
+
+func parseLogFormat(value string) (logFormat, error) {
+	switch logFormat(value) {
+	case formatText, formatJson:
+		return logFormat(value), nil
+	}
+	return formatText, errors.New("invalid log format: " + value)
+}
+
+// logger Writes leveled lines with a message and key-value fields, either as
+// text or JSON. The fields given with "with" are written on every line.
+type logger struct {
+	sink   *logSink
+	fields []any
+}
+
+type logSink struct {
+	mu     sync.Mutex
+	out    io.Writer
+	level  logLevel
+	format logFormat
+}
+
+func newLogger(out io.Writer, level logLevel, format logFormat) logger {
+	return logger{
+		sink: &logSink{out: out, level: level, format: format},
+	}
+}
+
+// Returns a logger with the given key-value pairs added to its fields.
+func (l logger) with(kv ...any) logger {
+	fields := make([]any, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return logger{sink: l.sink, fields: fields}
+}
+
+func (l logger) debug(msg string, kv ...any) {
+	l.log(levelDebug, msg, kv)
+}
+
+func (l logger) info(msg string, kv ...any) {
+	l.log(levelInfo, msg, kv)
+}
+
+func (l logger) warn(msg string, kv ...any) {
+	l.log(levelWarn, msg, kv)
+}
+
+func (l logger) error(msg string, kv ...any) {
+	l.log(levelError, msg, kv)
+}
+
+func (l logger) log(level logLevel, msg string, kv []any) {
+	if l.sink == nil || level < l.sink.level {
+		return
+	}
+	fields := make([]any, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	now := time.Now().Format(time.RFC3339Nano)
+	var line []byte
+
+	switch l.sink.format {
+	case formatJson:
+		line = formatJsonLine(now, level, msg, fields)
+	default:
+		line = formatTextLine(now, level, msg, fields)
+	}
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+	_, _ = l.sink.out.Write(line)
+}
+
+func formatTextLine(now string, level logLevel, msg string, fields []any) []byte {
+	var b bytes.Buffer
+	b.WriteString(now)
+	b.WriteByte(' ')
+	b.WriteString(level.String())
+	b.WriteByte(' ')
+	b.WriteString(quoteIfNeeded(msg))
+	for i := 0; i < len(fields); i += 2 {
+		b.WriteByte(' ')
+		b.WriteString(fieldKey(fields, i))
+		b.WriteByte('=')
+		b.WriteString(quoteIfNeeded(fmt.Sprint(fieldValue(fields, i))))
+	}
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+func formatJsonLine(now string, level logLevel, msg string, fields []any) []byte {
+	var b bytes.Buffer
+	writeJsonField(&b, "time", now)
+	b.WriteByte(',')
+	writeJsonField(&b, "level", level.String())
+	b.WriteByte(',')
+	writeJsonField(&b, "msg", msg)
+	for i := 0; i < len(fields); i += 2 {
+		b.WriteByte(',')
+		writeJsonField(&b, fieldKey(fields, i), fieldValue(fields, i))
+	}
+	return append(append([]byte{'{'}, b.Bytes()...), '}', '\n')
+}
+
+func writeJsonField(b *bytes.Buffer, key string, value any) {
+	k, _ := json.Marshal(key)
+	v, err := json.Marshal(value)
+	if err != nil {
+		v, _ = json.Marshal(fmt.Sprint(value))
+	}
+	b.Write(k)
+	b.WriteByte(':')
+	b.Write(v)
+}
+
+func fieldKey(fields []any, i int) string {
+	return fmt.Sprint(fields[i])
+}
+
+// Returns the value of the field at i, errors are written by their message.
+func fieldValue(fields []any, i int) any {
+	if i+1 >= len(fields) {
+		return "!MISSING"
+	}
+	if err, ok := fields[i+1].(error); ok {
+		return err.Error()
+	}
+	return fields[i+1]
+}
+
+func quoteIfNeeded(value string) string {
+	if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// stdLogWriter Redirects the lines of the standard log package, which is used
+// by the lower level packages, to the logger.
+type stdLogWriter struct {
+	logger
+}
+
+func (w stdLogWriter) Write(p []byte) (int, error) {
+	w.info(strings.TrimSpace(string(p)))
+	return len(p), nil
+}
@@ -0,0 +1,48 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fs/utils"
+	"strings"
+	"testing"
+)
+
+func TestLoggerText(t *testing.T) {
+	var out bytes.Buffer
+	l := newLogger(&out, levelInfo, formatText).with("cid", 3, "channel", "test")
+
+	l.debug("Hidden line")
+	l.warn("Fail to read chunk", "err", errors.New("read timeout"))
+	line := out.String()
+
+	if strings.Contains(line, "Hidden line") {
+		t.Fatal("Lines below the log level must be discarded")
+	}
+	expected := `WARN "Fail to read chunk" cid=3 channel=test err="read timeout"`
+	if !strings.HasSuffix(strings.TrimSpace(line), expected) {
+		t.Fatal("Wrong text line:", line)
+	}
+}
+
+func TestLoggerJson(t *testing.T) {
+	var out bytes.Buffer
+	l := newLogger(&out, levelDebug, formatJson).with("cid", 3)
+
+	l.info("Client connected", "addr", "127.0.0.1:5000")
+	line := make(map[string]any)
+	err := json.Unmarshal(out.Bytes(), &line)
+
+	utils.RequirePassCase(t, err, "Fail to read JSON line")
+	if line["level"] != "INFO" || line["msg"] != "Client connected" {
+		t.Fatal("Wrong JSON line:", out.String())
+	}
+	if line["cid"] != float64(3) || line["addr"] != "127.0.0.1:5000" {
+		t.Fatal("Wrong JSON fields:", out.String())
+	}
+}
@@ -20,11 +20,12 @@ const (
 )
 
 func main() {
+	cfg := loadConfig()
 	server, err := net.Listen(network, getServerAddress())
 
 	defer server.Close()
 	utils.RequireNoError(err)
-	listen(server)
+	listen(server, cfg)
 }
 
 func getServerAddress() string {
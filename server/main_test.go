@@ -114,9 +114,17 @@ func TestBroadcast(t *testing.T) {
 		conn, _ := net.DialTCP(network, nil, tcpAddr)
 
 		log.Println("HOLD: Connection established")
-		msg, _ := readMessage(conn, readTimeOut)
+
+		// Updates are only sent to the clients of the channel that changed
+		cmd := map[string]string{"REQ": "SUBSCRIBE", "CHANNEL": testChannel}
+		_ = writeMessage(Message{Command: cmd}, conn)
+		msg, _ := readMessage(conn, readTimeOut) // Subscribe OK
+		msg, _ = readMessage(conn, readTimeOut)
 		log.Println("Received msg:", msg)
-		if msg.Response != Update {
+		payload, _ := msg.UpdatePayload()
+		if msg.Response != Update ||
+			payload.Channel != testChannel ||
+			(payload.Type != ChangeFileAdded && payload.Type != ChangeFileReplaced) {
 			fail <- struct{}{}
 			return
 		}
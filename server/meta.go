@@ -0,0 +1,262 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fs"
+	"fs/process"
+	"fs/utils"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	metaFileSuffix     = ".meta.json"
+	maxMetaKeys        = 32
+	maxMetaKeyLength   = 64
+	maxMetaValueLength = 256
+	maxTags            = 32
+	maxTagLength       = 64
+)
+
+// FileMeta The custom metadata and tags of a file, like its author or review
+// status.
+type FileMeta struct {
+	Metadata map[string]string `json:",omitempty"`
+	Tags     []string          `json:",omitempty"`
+}
+
+func (m FileMeta) isEmpty() bool {
+	return len(m.Metadata) == 0 && len(m.Tags) == 0
+}
+
+// Returns the metadata with the keys and tags of the other added, which
+// replace the ones with the same key.
+func (m FileMeta) merge(other FileMeta) FileMeta {
+	merged := FileMeta{Metadata: make(map[string]string), Tags: make([]string, 0)}
+	for key, value := range m.Metadata {
+		merged.Metadata[key] = value
+	}
+	for key, value := range other.Metadata {
+		merged.Metadata[key] = value
+	}
+	merged.Tags = appendTags(merged.Tags, m.Tags...)
+	merged.Tags = appendTags(merged.Tags, other.Tags...)
+	return merged
+}
+
+// Returns an error if the metadata has too many or too long keys, values or
+// tags.
+func (m FileMeta) validate() error {
+	if len(m.Metadata) > maxMetaKeys {
+		return errors.New("too many metadata keys")
+	}
+	for key, value := range m.Metadata {
+		length := utf8.RuneCountInString(key)
+		if length == 0 || length > maxMetaKeyLength {
+			return errors.New("invalid metadata key")
+		}
+		if utf8.RuneCountInString(value) > maxMetaValueLength {
+			return errors.New("metadata value too long")
+		}
+	}
+	if len(m.Tags) > maxTags {
+		return errors.New("too many tags")
+	}
+	for _, tag := range m.Tags {
+		length := utf8.RuneCountInString(tag)
+		if length == 0 || length > maxTagLength {
+			return errors.New("invalid tag")
+		}
+	}
+	return nil
+}
+
+// FileStat Describes a file of a channel, sent to the STAT command and to
+// LIST_FILES when the metadata is requested.
+type FileStat struct {
+	Channel string
+	Name    string
+	Size    uint64
+	ModTime time.Time
+	FileMeta
+}
+
+// metaStore Keeps the metadata of the files of each channel in a sidecar
+// index next to the channel, at .{channel}.meta.json in the FS root.
+type metaStore struct {
+	mu       sync.Mutex
+	osFsRoot string
+}
+
+func newMetaStore(osFsRoot string) *metaStore {
+	return &metaStore{osFsRoot: osFsRoot}
+}
+
+// Returns the metadata of the file, which is empty if it has none.
+func (m *metaStore) get(channel process.Channel, file string) (FileMeta, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	index, err := m.read(channel)
+	return index[file], err
+}
+
+// Returns the metadata of every file of the channel that has any.
+func (m *metaStore) getAll(channel process.Channel) (map[string]FileMeta, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.read(channel)
+}
+
+// Adds the metadata and tags to the ones of the file, and returns the result.
+func (m *metaStore) set(channel process.Channel, file string, meta FileMeta) (FileMeta, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	index, err := m.read(channel)
+	if err != nil {
+		return FileMeta{}, err
+	}
+	merged := index[file].merge(meta)
+	err = merged.validate()
+	if err != nil {
+		return index[file], err
+	}
+	index[file] = merged
+	return merged, m.write(channel, index)
+}
+
+// Removes the given metadata keys and tags of the file, or all of them if none
+// is given, and returns what's left.
+func (m *metaStore) remove(
+	channel process.Channel,
+	file string,
+	keys []string,
+	tags []string,
+) (FileMeta, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	index, err := m.read(channel)
+	if err != nil {
+		return FileMeta{}, err
+	}
+	meta := FileMeta{}
+	if len(keys) > 0 || len(tags) > 0 {
+		meta = index[file].merge(FileMeta{})
+		for _, key := range keys {
+			delete(meta.Metadata, key)
+		}
+		meta.Tags = removeTags(meta.Tags, tags)
+	}
+	if meta.isEmpty() {
+		delete(index, file)
+	} else {
+		index[file] = meta
+	}
+	return meta, m.write(channel, index)
+}
+
+// Moves the metadata index of the channel to the path, if it has any.
+func (m *metaStore) moveChannel(channel process.Channel, path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return renameIfExists(m.path(channel), path)
+}
+
+// Moves back the metadata index of the channel from the path, if there's any.
+func (m *metaStore) restoreChannel(channel process.Channel, path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return renameIfExists(path, m.path(channel))
+}
+
+// Returns the metadata index of the channel. It must be called with the lock
+// held.
+func (m *metaStore) read(channel process.Channel) (map[string]FileMeta, error) {
+	index := make(map[string]FileMeta)
+	if _, err := channel.File(); err != nil || channel.Name == "" {
+		return index, errors.New("invalid channel")
+	}
+	data, err := ioutil.ReadFile(m.path(channel))
+	if errors.Is(err, os.ErrNotExist) {
+		return index, nil
+	}
+	if err != nil {
+		return index, err
+	}
+	err = json.Unmarshal(data, &index)
+	return index, err
+}
+
+// Persists the metadata index of the channel, or deletes it if it's empty. It
+// must be called with the lock held.
+func (m *metaStore) write(channel process.Channel, index map[string]FileMeta) error {
+	if len(index) == 0 {
+		err := os.Remove(m.path(channel))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(m.path(channel), data, 0644)
+}
+
+func (m *metaStore) path(channel process.Channel) string {
+	return m.osFsRoot + fs.Separator + "." + channel.Name + metaFileSuffix
+}
+
+// Returns the metadata given by the METADATA, as a JSON object of strings, and
+// the TAGS, as comma separated values.
+func parseFileMeta(cmd map[string]string) (FileMeta, error) {
+	meta := FileMeta{}
+	if value := cmd["METADATA"]; value != "" {
+		err := json.Unmarshal([]byte(value), &meta.Metadata)
+		if err != nil {
+			return meta, errors.New("invalid METADATA")
+		}
+	}
+	meta.Tags = parseList(cmd["TAGS"])
+	return meta, meta.validate()
+}
+
+// Returns the values of the comma separated list, without the empty ones.
+func parseList(value string) []string {
+	list := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// Appends the tags that are not in the list already.
+func appendTags(list []string, tags ...string) []string {
+	for _, tag := range tags {
+		if !utils.StringSliceContains(list, tag) {
+			list = append(list, tag)
+		}
+	}
+	return list
+}
+
+func removeTags(list []string, tags []string) []string {
+	kept := make([]string, 0, len(list))
+	for _, t := range list {
+		if !utils.StringSliceContains(tags, t) {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
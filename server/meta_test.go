@@ -0,0 +1,104 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"fs"
+	"fs/process"
+	"fs/utils"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestMetaStore(t *testing.T) {
+	root := t.TempDir()
+	store := newMetaStore(root)
+	channel := process.NewChannel("test")
+
+	_, err := store.set(channel, "doc.txt", FileMeta{
+		Metadata: map[string]string{"author": "ana", "status": "draft"},
+		Tags:     []string{"report"},
+	})
+	utils.RequirePassCase(t, err, "Fail to set metadata")
+	meta, err := store.set(channel, "doc.txt", FileMeta{
+		Metadata: map[string]string{"status": "reviewed"},
+		Tags:     []string{"report", "q1"},
+	})
+	utils.RequirePassCase(t, err, "Fail to merge metadata")
+	expected := FileMeta{
+		Metadata: map[string]string{"author": "ana", "status": "reviewed"},
+		Tags:     []string{"report", "q1"},
+	}
+	if !reflect.DeepEqual(meta, expected) {
+		t.Fatalf("Expected merged metadata %v, got %v", expected, meta)
+	}
+
+	// It survives a restart
+	meta, err = newMetaStore(root).get(channel, "doc.txt")
+	utils.RequirePassCase(t, err, "Fail to get metadata")
+	if !reflect.DeepEqual(meta, expected) {
+		t.Fatalf("Expected persisted metadata %v, got %v", expected, meta)
+	}
+
+	meta, err = store.remove(channel, "doc.txt", []string{"author"}, []string{"q1"})
+	utils.RequirePassCase(t, err, "Fail to remove metadata")
+	expected = FileMeta{
+		Metadata: map[string]string{"status": "reviewed"},
+		Tags:     []string{"report"},
+	}
+	if !reflect.DeepEqual(meta, expected) {
+		t.Fatalf("Expected metadata %v left, got %v", expected, meta)
+	}
+
+	_, err = store.remove(channel, "doc.txt", nil, nil)
+	utils.RequirePassCase(t, err, "Fail to remove all metadata")
+	if _, err = os.Stat(store.path(channel)); !os.IsNotExist(err) {
+		t.Fatal("Empty metadata index not deleted")
+	}
+}
+
+func TestMetaStoreMoveChannel(t *testing.T) {
+	root := t.TempDir()
+	store := newMetaStore(root)
+	channel := process.NewChannel("test")
+	meta := FileMeta{Tags: []string{"report"}}
+	_, err := store.set(channel, "doc.txt", meta)
+	utils.RequirePassCase(t, err, "Fail to set metadata")
+
+	path := t.TempDir() + fs.Separator + trashMeta
+	utils.RequirePassCase(t, store.moveChannel(channel, path), "Fail to move channel metadata")
+	if all, _ := store.getAll(channel); len(all) != 0 {
+		t.Fatal("Channel metadata not moved")
+	}
+	utils.RequirePassCase(t, store.restoreChannel(channel, path), "Fail to restore channel metadata")
+	restored, err := store.get(channel, "doc.txt")
+	utils.RequirePassCase(t, err, "Fail to get metadata")
+	if !reflect.DeepEqual(restored, meta) {
+		t.Fatalf("Expected restored metadata %v, got %v", meta, restored)
+	}
+}
+
+func TestFileMetaValidate(t *testing.T) {
+	cases := []map[string]string{
+		{"METADATA": `{"":"empty key"}`},
+		{"METADATA": `not json`},
+		{"METADATA": `{"n":1}`},
+		{"TAGS": string(make([]rune, maxTagLength+1))},
+	}
+	for _, cmd := range cases {
+		if _, err := parseFileMeta(cmd); err == nil {
+			t.Errorf("Expected invalid metadata for %v", cmd)
+		}
+	}
+	meta, err := parseFileMeta(map[string]string{
+		"METADATA": `{"author":"ana"}`,
+		"TAGS":     "report, q1,,",
+	})
+	utils.RequirePassCase(t, err, "Fail to parse metadata")
+	if !reflect.DeepEqual(meta.Tags, []string{"report", "q1"}) {
+		t.Errorf("Expected tags [report q1], got %v", meta.Tags)
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"fs/process"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const metricsPath = "/metrics"
+
+// Upper bounds in seconds of the transfer duration histogram buckets.
+var durationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 600, 1800}
+
+// metrics Records the server load, and writes it in the Prometheus text
+// exposition format.
+type metrics struct {
+	mu               sync.Mutex
+	connectedClients int
+	activeTransfers  map[string]int64
+	bytes            map[string]uint64
+	durations        map[string]*histogram
+	commands         map[string]uint64
+	errors           map[string]uint64
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		activeTransfers: make(map[string]int64),
+		bytes:           make(map[string]uint64),
+		durations:       make(map[string]*histogram),
+		commands:        make(map[string]uint64),
+		errors:          make(map[string]uint64),
+	}
+	for _, action := range process.Actions() {
+		m.activeTransfers[action] = 0
+		m.bytes[action] = 0
+		m.durations[action] = newHistogram(durationBuckets)
+	}
+	return m
+}
+
+func (m *metrics) setConnectedClients(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.connectedClients = n
+}
+
+func (m *metrics) transferStarted(action process.Action) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.activeTransfers[actionLabel(action)]++
+}
+
+func (m *metrics) transferEnded(action process.Action, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	label := actionLabel(action)
+	m.activeTransfers[label]--
+	if h, ok := m.durations[label]; ok {
+		h.observe(duration.Seconds())
+	}
+}
+
+func (m *metrics) transferred(action process.Action, n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bytes[actionLabel(action)] += uint64(n)
+}
+
+func (m *metrics) command(req req) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.commands[string(req)]++
+}
+
+func (m *metrics) error(msg string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errors[errorReason(msg)]++
+}
+
+func (m *metrics) write(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b := bufio.NewWriter(w)
+
+	writeHeader(b, "fs_connected_clients", "gauge",
+		"Clients connected to the server.")
+	writeSample(b, "fs_connected_clients", "", m.connectedClients)
+
+	writeHeader(b, "fs_active_transfers", "gauge",
+		"Transfers in progress by action.")
+	for _, action := range sortedKeys(m.activeTransfers) {
+		labels := "action=" + quoteLabel(action)
+		writeSample(b, "fs_active_transfers", labels, m.activeTransfers[action])
+	}
+
+	writeHeader(b, "fs_transferred_bytes_total", "counter",
+		"Bytes uploaded and downloaded by action.")
+	for _, action := range sortedKeys(m.bytes) {
+		labels := "action=" + quoteLabel(action)
+		writeSample(b, "fs_transferred_bytes_total", labels, m.bytes[action])
+	}
+
+	writeHeader(b, "fs_transfer_duration_seconds", "histogram",
+		"Duration of the transfers by action.")
+	for _, action := range sortedKeys(m.durations) {
+		labels := "action=" + quoteLabel(action)
+		m.durations[action].write(b, "fs_transfer_duration_seconds", labels)
+	}
+
+	writeHeader(b, "fs_commands_total", "counter",
+		"Commands received by REQ.")
+	for _, req := range sortedKeys(m.commands) {
+		labels := "req=" + quoteLabel(req)
+		writeSample(b, "fs_commands_total", labels, m.commands[req])
+	}
+
+	writeHeader(b, "fs_errors_total", "counter",
+		"Errors sent to the clients by reason.")
+	for _, reason := range sortedKeys(m.errors) {
+		labels := "reason=" + quoteLabel(reason)
+		writeSample(b, "fs_errors_total", labels, m.errors[reason])
+	}
+	return b.Flush()
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = m.write(w)
+}
+
+type histogram struct {
+	bounds []float64
+	counts []uint64 // Non-cumulative count of each bound
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)),
+	}
+}
+
+func (h *histogram) observe(value float64) {
+	for i, bound := range h.bounds {
+		if value <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name string, labels string) {
+	cumulative := uint64(0)
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		le := strconv.FormatFloat(bound, 'g', -1, 64)
+		writeSample(w, name+"_bucket", labels+",le="+quoteLabel(le), cumulative)
+	}
+	writeSample(w, name+"_bucket", labels+`,le="+Inf"`, h.count)
+	writeSample(w, name+"_sum", labels, h.sum)
+	writeSample(w, name+"_count", labels, h.count)
+}
+
+// Starts the HTTP server of the metrics endpoint. It does nothing if the
+// address is empty.
+func serveMetrics(addr string, m *metrics, log logger) {
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle(metricsPath, m)
+	go func() {
+		log.info("Serving metrics", "addr", addr, "path", metricsPath)
+		err := http.ListenAndServe(addr, mux)
+		log.error("Metrics server stopped", "err", err)
+	}()
+}
+
+func writeHeader(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %v %v\n", name, help)
+	fmt.Fprintf(w, "# TYPE %v %v\n", name, kind)
+}
+
+func writeSample(w io.Writer, name string, labels string, value any) {
+	if labels == "" {
+		fmt.Fprintf(w, "%v %v\n", name, value)
+		return
+	}
+	fmt.Fprintf(w, "%v{%v} %v\n", name, labels, value)
+}
+
+func quoteLabel(value string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + r.Replace(value) + `"`
+}
+
+// Returns the name of the action, or unknown if it's not a valid one.
+func actionLabel(action process.Action) string {
+	actions := process.Actions()
+	if int(action) >= len(actions) {
+		return "unknown"
+	}
+	return actions[action]
+}
+
+// Returns the reason of an error message without the details after a colon,
+// so that the number of reasons stays bounded.
+func errorReason(msg string) string {
+	reason := strings.ToLower(strings.TrimSpace(strings.SplitN(msg, ":", 2)[0]))
+	if reason == "" {
+		return "unknown"
+	}
+	return reason
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"bytes"
+	"fs/process"
+	"fs/utils"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsWrite(t *testing.T) {
+	m := newMetrics()
+	m.setConnectedClients(2)
+	m.transferStarted(process.ActionUpload)
+	m.transferred(process.ActionUpload, 1024)
+	m.transferEnded(process.ActionUpload, 2*time.Second)
+	m.command(CID)
+	m.error("quota exceeded: channel storage limit reached")
+
+	var out bytes.Buffer
+	err := m.write(&out)
+	utils.RequirePassCase(t, err, "Fail to write metrics")
+	expected := []string{
+		"# TYPE fs_connected_clients gauge",
+		"fs_connected_clients 2",
+		`fs_active_transfers{action="upload"} 0`,
+		`fs_transferred_bytes_total{action="upload"} 1024`,
+		`fs_transfer_duration_seconds_bucket{action="upload",le="1"} 0`,
+		`fs_transfer_duration_seconds_bucket{action="upload",le="5"} 1`,
+		`fs_transfer_duration_seconds_bucket{action="upload",le="+Inf"} 1`,
+		`fs_transfer_duration_seconds_count{action="upload"} 1`,
+		`fs_commands_total{req="CID"} 1`,
+		`fs_errors_total{reason="quota exceeded"} 1`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Fatal("Missing metrics line:", line, "\n", out.String())
+		}
+	}
+}
+
+func TestMetricsInvalidAction(t *testing.T) {
+	m := newMetrics()
+	action := process.Action(len(process.Actions()))
+	m.transferStarted(action)
+	m.transferred(action, 1024)
+	m.transferEnded(action, time.Second)
+	if label := actionLabel(action); label != "unknown" {
+		t.Fatalf("Expected unknown action label, got %v", label)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"errors"
+	"fs/utils"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const maxProfileNameLength = 32
+
+var (
+	profileDevices  = []string{"android", "web", "desktop", "other"}
+	profileStatuses = []string{"idle", "uploading", "downloading", "away"}
+)
+
+// Profile Describes the client to humans. It's set by the client itself with
+// the SET_PROFILE command.
+type Profile struct {
+	Name   string
+	Device string
+	Status string
+}
+
+// Returns the profile with the NAME, DEVICE and STATUS given, keeping the
+// current values of the ones not given.
+func parseProfile(cmd map[string]string, current Profile) (Profile, error) {
+	profile := current
+	if name, ok := cmd["NAME"]; ok {
+		name = strings.TrimSpace(name)
+		if !isValidProfileName(name) {
+			return current, errors.New("invalid NAME")
+		}
+		profile.Name = name
+	}
+	if device, ok := cmd["DEVICE"]; ok {
+		if !utils.StringSliceContains(profileDevices, device) {
+			return current, errors.New("invalid DEVICE")
+		}
+		profile.Device = device
+	}
+	if status, ok := cmd["STATUS"]; ok {
+		if !utils.StringSliceContains(profileStatuses, status) {
+			return current, errors.New("invalid STATUS")
+		}
+		profile.Status = status
+	}
+	return profile, nil
+}
+
+func isValidProfileName(name string) bool {
+	length := utf8.RuneCountInString(name)
+	if length == 0 || length > maxProfileNameLength {
+		return false
+	}
+	for _, r := range name {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,36 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseProfile(t *testing.T) {
+	current := Profile{Name: "Tobi", Device: "desktop", Status: "idle"}
+	cmd := map[string]string{"NAME": "  Tobi's phone ", "DEVICE": "android"}
+	profile, err := parseProfile(cmd, current)
+	if err != nil {
+		t.Fatal("Fail to parse profile:", err)
+	}
+	expected := Profile{Name: "Tobi's phone", Device: "android", Status: "idle"}
+	if profile != expected {
+		t.Fatal("Wrong profile:", profile)
+	}
+
+	invalid := []map[string]string{
+		{"NAME": " "},
+		{"NAME": strings.Repeat("a", maxProfileNameLength+1)},
+		{"NAME": "new\nline"},
+		{"DEVICE": "toaster"},
+		{"STATUS": "sleeping"},
+	}
+	for _, cmd := range invalid {
+		if _, err := parseProfile(cmd, current); err == nil {
+			t.Fatal("Invalid profile accepted:", cmd)
+		}
+	}
+}
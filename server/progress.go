@@ -0,0 +1,64 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"time"
+)
+
+const progressInterval = 250 * time.Millisecond
+
+// progressTracker Limits the PERCENT events of a transfer, so they are emitted
+// only when the percent changes and not more often than the progress interval.
+type progressTracker struct {
+	percent int
+	last    time.Time
+}
+
+func (t *progressTracker) reset(now time.Time) {
+	t.percent = 0
+	t.last = now
+}
+
+// Returns the percent of the transfer and whether it has to be emitted.
+func (t *progressTracker) next(info TransferInfo, now time.Time) (int, bool) {
+	percent := transferPercent(info)
+	if percent <= t.percent || now.Sub(t.last) < progressInterval {
+		return percent, false
+	}
+	t.percent = percent
+	t.last = now
+	return percent, true
+}
+
+func transferPercent(info TransferInfo) int {
+	if info.Size == 0 {
+		return 100
+	}
+	if info.Bytes >= info.Size {
+		return 100
+	}
+	return int(info.Bytes * 100 / info.Size)
+}
+
+func newProgressPayload(event ProgressEvent, info TransferInfo) ProgressPayload {
+	return ProgressPayload{
+		Event:    event,
+		Transfer: info.ID,
+		CID:      info.CID,
+		Action:   info.Action,
+		Channel:  info.Channel,
+		File:     info.File,
+		Size:     info.Size,
+		Bytes:    info.Bytes,
+		Percent:  transferPercent(info),
+	}
+}
+
+type observeRequest struct {
+	client  *Client
+	channel string
+	observe bool // Whether to start or stop observing the channel
+}
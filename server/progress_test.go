@@ -0,0 +1,64 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProgressTracker(t *testing.T) {
+	start := time.Now()
+	tracker := progressTracker{}
+	info := TransferInfo{Size: 1000}
+	tracker.reset(start)
+
+	info.Bytes = 500
+	if _, ok := tracker.next(info, start.Add(progressInterval/2)); ok {
+		t.Fatal("Progress emitted before the interval")
+	}
+	percent, ok := tracker.next(info, start.Add(progressInterval))
+	if !ok || percent != 50 {
+		t.Fatal("Progress not emitted after the interval:", percent)
+	}
+	info.Bytes = 505
+	if _, ok := tracker.next(info, start.Add(3*progressInterval)); ok {
+		t.Fatal("Progress emitted without a percent change")
+	}
+	info.Bytes = 1000
+	percent, ok = tracker.next(info, start.Add(4*progressInterval))
+	if !ok || percent != 100 {
+		t.Fatal("Progress not emitted at the end:", percent)
+	}
+	if transferPercent(TransferInfo{}) != 100 {
+		t.Fatal("Empty file must be 100%")
+	}
+}
+
+func TestHubBroadcastProgress(t *testing.T) {
+	hub := NewHub(logger{}, newMetrics(), nil)
+	sender := &Client{id: 1, out: newOutbox(nil, outboxSize, nil)}
+	observer := &Client{id: 2, out: newOutbox(nil, outboxSize, nil)}
+	other := &Client{id: 3, out: newOutbox(nil, outboxSize, nil)}
+	hub.observeChannel(observeRequest{client: sender, channel: "test", observe: true})
+	hub.observeChannel(observeRequest{client: observer, channel: "test", observe: true})
+	hub.observeChannel(observeRequest{client: other, channel: "main", observe: true})
+
+	p := ProgressPayload{Event: ProgressStarted, CID: 1, Channel: "test"}
+	hub.broadcastProgress(p)
+
+	if len(observer.out.pushes) != 1 || observer.out.pushes[0].priority != priorityLow {
+		t.Fatal("Observer didn't receive the event")
+	}
+	if len(sender.out.pushes) != 0 || len(other.out.pushes) != 0 {
+		t.Fatal("Event sent to a client not observing it")
+	}
+
+	hub.observeChannel(observeRequest{client: observer, channel: "test", observe: false})
+	hub.broadcastProgress(p)
+	if len(observer.out.pushes) != 1 {
+		t.Fatal("Event sent after unsubscribing")
+	}
+}
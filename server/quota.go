@@ -0,0 +1,162 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fs"
+	"fs/files"
+	"fs/process"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+const quotasFile = "quotas.json"
+
+type QuotaPayload struct {
+	Channel string
+	Usage   process.Usage
+	Quota   process.Quota
+}
+
+// quotaTable Implements the process.Quotas for the channels of the server.
+// The limits are set by admins and persisted into the data root, while the
+// usage is read from the FS the first time it's required, and then kept up to
+// date by the uploads.
+type quotaTable struct {
+	mu       sync.Mutex
+	osFsRoot string
+	path     string
+	limits   map[string]process.Quota
+	usage    map[string]*process.Usage
+	log      logger
+}
+
+func loadQuotaTable(
+	osFsRoot string,
+	osDataRoot string,
+	log logger,
+) (*quotaTable, error) {
+	t := &quotaTable{
+		osFsRoot: osFsRoot,
+		path:     osDataRoot + fs.Separator + quotasFile,
+		limits:   make(map[string]process.Quota),
+		usage:    make(map[string]*process.Usage),
+		log:      log,
+	}
+	data, err := ioutil.ReadFile(t.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &t.limits)
+	return t, err
+}
+
+func (t *quotaTable) Reserve(channel process.Channel, bytes int64, n int64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	quota := t.limits[channel.Name]
+	usage, err := t.readUsage(channel)
+	if err != nil {
+		t.log.error("Fail to read channel usage", "channel", channel.Name, "err", err)
+		return errors.New("fail to read channel usage")
+	}
+	if quota.MaxBytes > 0 && int64(usage.Bytes)+bytes > int64(quota.MaxBytes) {
+		return errors.New("quota exceeded: channel storage limit reached")
+	}
+	if quota.MaxFiles > 0 && int64(usage.Files)+n > int64(quota.MaxFiles) {
+		return errors.New("quota exceeded: channel file limit reached")
+	}
+	usage.Bytes = addClamped(usage.Bytes, bytes)
+	usage.Files = addClamped(usage.Files, n)
+	return nil
+}
+
+func (t *quotaTable) Add(channel process.Channel, bytes int64, n int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	usage, err := t.readUsage(channel)
+	if err != nil {
+		t.log.error("Fail to read channel usage", "channel", channel.Name, "err", err)
+		return
+	}
+	usage.Bytes = addClamped(usage.Bytes, bytes)
+	usage.Files = addClamped(usage.Files, n)
+}
+
+// Drops the cached usage of the channel, so it's read from the FS next time.
+// It must be called when the channel content changes without an upload.
+func (t *quotaTable) invalidate(channel process.Channel) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.usage, channel.Name)
+}
+
+func (t *quotaTable) set(channel process.Channel, quota process.Quota) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if quota == (process.Quota{}) {
+		delete(t.limits, channel.Name)
+	} else {
+		t.limits[channel.Name] = quota
+	}
+	data, err := json.Marshal(t.limits)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(t.path, data, 0644)
+}
+
+func (t *quotaTable) report(channel process.Channel) (QuotaPayload, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	usage, err := t.readUsage(channel)
+	if err != nil {
+		return QuotaPayload{}, err
+	}
+	return QuotaPayload{
+		Channel: channel.Name,
+		Usage:   *usage,
+		Quota:   t.limits[channel.Name],
+	}, nil
+}
+
+func (t *quotaTable) readUsage(channel process.Channel) (*process.Usage, error) {
+	if usage, ok := t.usage[channel.Name]; ok {
+		return usage, nil
+	}
+	dir, err := channel.File()
+	if err != nil {
+		return nil, err
+	}
+	usage := &process.Usage{}
+	osDir := dir.ToOsFile(t.osFsRoot)
+	exists, err := files.Exists(osDir)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		size, count, err := files.ReadDirSize(osDir)
+		if err != nil {
+			return nil, err
+		}
+		usage.Bytes = uint64(size)
+		usage.Files = uint64(count)
+	}
+	t.usage[channel.Name] = usage
+	return usage, nil
+}
+
+func addClamped(value uint64, delta int64) uint64 {
+	if delta < 0 && uint64(-delta) > value {
+		return 0
+	}
+	return uint64(int64(value) + delta)
+}
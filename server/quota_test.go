@@ -0,0 +1,109 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"fs"
+	"fs/process"
+	"fs/utils"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestQuotaTable(t *testing.T) {
+	osFsRoot := t.TempDir()
+	osDataRoot := t.TempDir()
+	channel := process.NewChannel(testChannel)
+	err := os.Mkdir(osFsRoot+"/"+testChannel, os.ModePerm)
+	utils.RequirePassCase(t, err, "Fail to create test channel")
+	err = os.WriteFile(osFsRoot+"/"+testChannel+"/a.txt", make([]byte, 60), 0644)
+	utils.RequirePassCase(t, err, "Fail to create test file")
+
+	quotas, err := loadQuotaTable(osFsRoot, osDataRoot, logger{})
+	utils.RequirePassCase(t, err, "Fail to load quota table")
+	err = quotas.set(channel, process.Quota{MaxBytes: 100, MaxFiles: 2})
+	utils.RequirePassCase(t, err, "Fail to set quota")
+
+	err = quotas.Reserve(channel, 41, 1)
+	utils.RequireFailureCase(t, err, "Upload exceeding the bytes must fail")
+	err = quotas.Reserve(channel, 40, 1)
+	utils.RequirePassCase(t, err, "Upload within the quota must be accepted")
+	err = quotas.Reserve(channel, 0, 1)
+	utils.RequireFailureCase(t, err, "Upload exceeding the files must fail")
+
+	// The limits are persisted, and the usage is read from the FS again
+	quotas, err = loadQuotaTable(osFsRoot, osDataRoot, logger{})
+	utils.RequirePassCase(t, err, "Fail to reload quota table")
+	report, err := quotas.report(channel)
+	utils.RequirePassCase(t, err, "Fail to read quota report")
+	if report.Quota.MaxBytes != 100 || report.Usage.Bytes != 60 {
+		t.Fatal("Wrong quota report:", report)
+	}
+}
+
+func TestQuotaTableConcurrentReserve(t *testing.T) {
+	channel := process.NewChannel(testChannel)
+	quotas, err := loadQuotaTable(t.TempDir(), t.TempDir(), logger{})
+	utils.RequirePassCase(t, err, "Fail to load quota table")
+	err = quotas.set(channel, process.Quota{MaxBytes: 100})
+	utils.RequirePassCase(t, err, "Fail to set quota")
+
+	var wg sync.WaitGroup
+	accepted := int32(0)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if quotas.Reserve(channel, 10, 1) == nil {
+				atomic.AddInt32(&accepted, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if accepted != 10 {
+		t.Fatal("Concurrent uploads must not overshoot the quota:", accepted)
+	}
+}
+
+// usageRecorder Quotas that only sums what is reserved and added.
+type usageRecorder struct {
+	bytes int64
+	files int64
+}
+
+func (r *usageRecorder) Reserve(_ process.Channel, bytes int64, files int64) error {
+	r.Add(process.Channel{}, bytes, files)
+	return nil
+}
+
+func (r *usageRecorder) Add(_ process.Channel, bytes int64, files int64) {
+	r.bytes += bytes
+	r.files += files
+}
+
+func TestQuotaFailedOverwrite(t *testing.T) {
+	osFsRoot := t.TempDir()
+	// A directory with content can't be removed to be replaced by the upload
+	dir := osFsRoot + "/" + testChannel + "/doc.txt"
+	utils.RequirePassCase(t, os.MkdirAll(dir, os.ModePerm), "Fail to create test dir")
+	err := os.WriteFile(dir+"/a.txt", make([]byte, 60), 0644)
+	utils.RequirePassCase(t, err, "Fail to create test file")
+
+	file, _ := fs.NewFileFromString("doc.txt")
+	quotas := &usageRecorder{}
+	p := process.NewProcess(osFsRoot, quotas, process.NoVersions{})
+	err = p.Start(process.StartPayload{
+		Action:   process.ActionUpload,
+		FileInfo: fs.FileInfo{File: file, Size: 1000},
+		Channel:  process.NewChannel(testChannel),
+	})
+	utils.RequireFailureCase(t, err, "Overwrite must fail")
+	p.Release()
+	if quotas.bytes != 0 || quotas.files != 0 {
+		t.Fatal("Failed overwrite must release its reservation only:", *quotas)
+	}
+}
@@ -5,8 +5,12 @@
 package main
 
 import (
+	"fs/hooks"
 	"log"
 	"net"
+	"os"
+	"sync/atomic"
+	"time"
 )
 
 type Response int
@@ -16,31 +20,132 @@ const (
 	Quit
 	Update
 	Ok
+	Progress
+	Presence
+	Chat
+	FileChange
 )
 
-func listen(server net.Listener) {
-	osFsRoot := loadRoot()
-	hub := NewHub()
+// services Holds the server state that is shared by all the clients.
+type services struct {
+	cfg         config
+	log         logger
+	transferSeq uint64 // Last ID given to a transfer
+	osFsRoot    string
+	osDataRoot  string
+	quotas      *quotaTable
+	throttle    *throttle
+	admission   *admission
+	metrics     *metrics
+	audit       *auditLog
+	events      *eventLog
+	chat        *chatHistory
+	versions    *versionStore
+	trash       *trash
+	blobs       *blobStore
+	meta        *metaStore
+	hooks       hooks.Chain
+}
 
-	log.Println("Server running on:", osFsRoot)
+func listen(server net.Listener, cfg config) {
+	svc := loadServices(cfg)
+	hub := NewHub(svc.log, svc.metrics, svc.events)
+
+	svc.log.info("Server running", "root", svc.osFsRoot)
 	go hub.run()
+	serveMetrics(cfg.metricsAddr, svc.metrics, svc.log)
+	serveAdminApi(cfg.adminAddr, svc, hub)
+	serveWebSocket(cfg.wsAddr, parseUrls(cfg.wsOrigins), svc, hub)
 	for {
 		conn, err := server.Accept()
 		if err != nil {
-			log.Println("Fail to accept client")
+			svc.log.error("Fail to accept client", "err", err)
 			continue
 		}
-		client := newClient(
-			conn,
-			osFsRoot,
-			hub.register,
-			hub.unregister,
-			hub.change,
-			hub.list,
-			hub.clientHubChange,
+		accept(conn, svc, hub)
+	}
+}
+
+// Admits the connection, either TCP or WebSocket, and runs it as a client of
+// the Hub.
+func accept(conn net.Conn, svc *services, hub *Hub) {
+	err := svc.admission.admit(conn)
+	if err != nil {
+		svc.log.warn(
+			"Rejecting client",
+			"addr", conn.RemoteAddr().String(),
+			"reason", err,
 		)
-		go client.run()
+		svc.metrics.error(err.Error())
+		// Don't hold the accept loop while the reason is sent
+		go reject(conn, err.Error())
+		return
 	}
+	client := newClient(
+		conn,
+		svc,
+		hub.register,
+		hub.unregister,
+		hub.change,
+		hub.list,
+		hub.clientHubChange,
+		hub.inspect,
+		hub.kick,
+		hub.setGlobal,
+		hub.presence,
+		hub.chat,
+		hub.subscription,
+		hub.watch,
+		hub.observe,
+		hub.activity,
+	)
+	client.id = hub.nextCid()
+	go client.run()
+}
+
+func loadServices(cfg config) *services {
+	l := loadLogger(cfg)
+	osFsRoot := loadRoot()
+	osDataRoot := loadDataRoot()
+	return &services{
+		cfg:        cfg,
+		log:        l,
+		osFsRoot:   osFsRoot,
+		osDataRoot: osDataRoot,
+		quotas:     loadQuotas(osFsRoot, osDataRoot, l),
+		throttle:   newThrottle(cfg),
+		admission:  newAdmission(cfg),
+		metrics:    newMetrics(),
+		audit:      loadAuditLog(osDataRoot),
+		events:     loadEvents(osDataRoot, cfg.eventLogSize),
+		chat:       loadChat(osDataRoot, cfg.chatHistorySize),
+		versions:   loadVersions(osDataRoot, cfg.maxVersions),
+		trash:      loadTrash(osDataRoot, cfg.trashRetention, l),
+		blobs:      loadBlobs(osFsRoot, osDataRoot, cfg.dedup, l),
+		meta:       newMetaStore(osFsRoot),
+		hooks:      loadHooks(cfg, osDataRoot, l),
+	}
+}
+
+// Returns the ID for a new transfer.
+func (s *services) nextTransferId() uint64 {
+	return atomic.AddUint64(&s.transferSeq, 1)
+}
+
+// Returns the server logger, which also takes the lines of the standard log.
+func loadLogger(cfg config) logger {
+	level, err := parseLogLevel(cfg.logLevel)
+	if err != nil {
+		panic(err)
+	}
+	format, err := parseLogFormat(cfg.logFormat)
+	if err != nil {
+		panic(err)
+	}
+	l := newLogger(os.Stderr, level, format)
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{l})
+	return l
 }
 
 func loadRoot() string {
@@ -50,3 +155,89 @@ func loadRoot() string {
 	}
 	return osFsRoot
 }
+
+func loadDataRoot() string {
+	osDataRoot, err := getOsDataRoot()
+	if err != nil {
+		panic("fail to load OS data root")
+	}
+	err = os.MkdirAll(osDataRoot, os.ModePerm)
+	if err != nil {
+		panic("fail to create OS data root")
+	}
+	return osDataRoot
+}
+
+func loadAuditLog(osDataRoot string) *auditLog {
+	audit, err := openAuditLog(osDataRoot)
+	if err != nil {
+		panic("fail to open audit log")
+	}
+	return audit
+}
+
+func loadEvents(osDataRoot string, size int) *eventLog {
+	events, err := loadEventLog(osDataRoot, size)
+	if err != nil {
+		panic("fail to load event log")
+	}
+	return events
+}
+
+func loadChat(osDataRoot string, size int) *chatHistory {
+	chat, err := loadChatHistory(osDataRoot, size)
+	if err != nil {
+		panic("fail to load chat history")
+	}
+	return chat
+}
+
+func loadVersions(osDataRoot string, max int) *versionStore {
+	versions, err := newVersionStore(osDataRoot, max)
+	if err != nil {
+		panic("fail to load file versions")
+	}
+	return versions
+}
+
+func loadTrash(osDataRoot string, retention time.Duration, log logger) *trash {
+	t, err := newTrash(osDataRoot, retention, log)
+	if err != nil {
+		panic("fail to load trash")
+	}
+	t.start()
+	return t
+}
+
+func loadBlobs(osFsRoot string, osDataRoot string, enabled bool, log logger) *blobStore {
+	blobs, err := newBlobStore(osFsRoot, osDataRoot, enabled, log)
+	if err != nil {
+		panic("fail to load blob store")
+	}
+	blobs.start()
+	return blobs
+}
+
+// Returns the hooks registered at startup, followed by the webhooks if any URL
+// was given.
+func loadHooks(cfg config, osDataRoot string, l logger) hooks.Chain {
+	chain := hooks.Registered()
+	urls := parseUrls(cfg.webhookUrls)
+	if len(urls) == 0 {
+		return chain
+	}
+	w, err := loadWebhooks(urls, cfg.webhookSecret, osDataRoot, l)
+	if err != nil {
+		panic("fail to load webhook queue")
+	}
+	w.start()
+	return append(chain, w)
+}
+
+func loadQuotas(osFsRoot string, osDataRoot string, l logger) *quotaTable {
+	quotas, err := loadQuotaTable(osFsRoot, osDataRoot, l)
+	if err != nil {
+		panic("fail to load channel quotas")
+	}
+	return quotas
+}
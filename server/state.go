@@ -5,32 +5,56 @@
 package main
 
 import (
+	"errors"
+	"fs/hooks"
 	"fs/process"
 	"io"
-	"log"
 	"net"
+	"os"
+	"time"
 )
 
+var errTransferAborted = errors.New("transfer aborted by an admin")
+
 type state struct {
-	conn    net.Conn
-	process process.Process
-	channel process.Channel
-	quit    func()
-	change  chan struct{}
+	conn     net.Conn
+	svc      *services
+	process  process.Process
+	meta     FileMeta // Metadata given for the file uploaded
+	status   *status
+	tracker  progressTracker
+	throttle *connThrottle
+	logger   func() logger
+	audit    func(e AuditEntry)
+	progress func(p ProgressPayload)
+	client   func() hooks.Client
+	quit     func()
+	change   chan UpdatePayload
 }
 
 func newState(
 	conn net.Conn,
-	osFsRoot string,
+	svc *services,
+	throttle *connThrottle,
+	logger func() logger,
+	audit func(e AuditEntry),
+	progress func(p ProgressPayload),
+	client func() hooks.Client,
 	quit func(),
-	change chan struct{},
+	change chan UpdatePayload,
 ) state {
 	return state{
-		conn:    conn,
-		process: process.NewProcess(osFsRoot),
-		channel: process.Channel{},
-		quit:    quit,
-		change:  change,
+		conn:     conn,
+		svc:      svc,
+		process:  process.NewProcess(svc.osFsRoot, svc.quotas, svc.versions),
+		status:   newStatus(),
+		throttle: throttle,
+		logger:   logger,
+		audit:    audit,
+		progress: progress,
+		client:   client,
+		quit:     quit,
+		change:   change,
 	}
 }
 
@@ -38,6 +62,7 @@ func (s *state) next() {
 	if s.isOnHold() {
 		return
 	}
+	defer s.syncStatus()
 	switch s.process.State() {
 	case process.Data:
 		s.listenData()
@@ -62,22 +87,40 @@ func (s state) isOnHold() bool {
 }
 
 func (s *state) start(msg Message) {
+	defer s.syncStatus()
+	s.status.setLastTransfer(s.svc.nextTransferId())
 	payload, err := msg.StartPayload()
 	if err != nil {
 		s.error("fail to read StartPayload")
 		return
 	}
+	s.meta = FileMeta{Metadata: payload.Metadata, Tags: payload.Tags}
+	err = s.meta.validate()
+	if err == nil {
+		err = s.startHook(payload)
+	}
+	if err != nil {
+		s.auditRejected(payload, err)
+		s.error(err.Error())
+		return
+	}
 	err = s.process.Start(payload)
 	if err != nil {
+		s.auditRejected(payload, err)
 		s.error(err.Error())
 		return
 	}
+	s.beginTransfer()
 	// TODO check breaks backward compatibility
 	//if s.process.User().Channel().Name != s.channel.Name {
 	//	s.error("Client channel doesn't match")
 	//	return
 	//}
-	log.Println("Accepting request:", payload)
+	s.log().info(
+		"Accepting request",
+		"action", actionLabel(s.process.Action()),
+		"size", payload.Size,
+	)
 	s.onProcessStarted()
 }
 
@@ -96,7 +139,7 @@ func (s *state) onActionUploadStarted() {
 		s.error("Fail to write state=DATA")
 		return
 	}
-	log.Println("State DATA sent")
+	s.log().debug("State DATA sent")
 }
 
 func (s *state) onActionDownloadStarted() {
@@ -109,11 +152,23 @@ func (s *state) listenData() {
 		s.handleReadError(err, "fail to read chunk")
 		return
 	}
+	if s.status.isAborted() {
+		s.error(errTransferAborted.Error())
+		return
+	}
+	// Wait after reading, so the read deadline is set again for the next chunk
+	// once the throttle allows it
+	channel := s.process.User().Channel()
+	if !s.throttle.wait(process.ActionUpload, channel, len(chunk), s.status.isAborted) {
+		s.error(errTransferAborted.Error())
+		return
+	}
 	err = s.process.Data(chunk)
 	if err != nil {
 		s.error(err.Error())
 		return
 	}
+	s.onTransferred(process.ActionUpload, len(chunk))
 }
 
 func (s *state) onChunkProcessed() {
@@ -132,7 +187,7 @@ func (s *state) handleEof() {
 		s.error("fail to write EOF state")
 		return
 	}
-	log.Println("State EOF sent, waiting for EOF message")
+	s.log().debug("State EOF sent, waiting for EOF message")
 	msg, err := readMessage(s.conn, readTimeOut)
 	if err != nil {
 		s.handleReadError(err, "fail to read EOF message")
@@ -154,7 +209,7 @@ func (s *state) eof(msg Message) {
 		s.error("expecting EOF")
 		return
 	}
-	log.Println("DONE!")
+	s.log().info("Transfer done")
 	err := s.process.Done()
 	if err != nil {
 		s.error("fail to write state=DONE on server")
@@ -165,11 +220,18 @@ func (s *state) eof(msg Message) {
 		s.error("fail to write state=DONE")
 		return
 	}
+	s.endTransfer(nil)
 
 	// If a file was uploaded, notify
 	if s.process.Action() == process.ActionUpload {
-		log.Println("File was uploaded, sending notification")
-		s.change <- struct{}{}
+		s.svc.hooks.OnUploadCompleted(s.client(), s.hookFile())
+		s.recordUploader()
+		s.storeMeta()
+		// Read the change first, as the blob may have an older ModTime
+		change := s.uploadChange()
+		s.storeBlob()
+		s.log().debug("File was uploaded, sending notification")
+		s.change <- change
 	}
 }
 
@@ -188,11 +250,11 @@ func (s *state) writeStreamState(payload process.StreamPayload) {
 		s.error("Fail to write state=STREAM")
 		return
 	}
-	log.Println("Payload sent, writing state=STREAM", payload)
+	s.log().debug("Payload sent, writing state=STREAM", "size", payload.Size)
 }
 
 func (s *state) listenStream() {
-	log.Println("Listening for client STREAM signal")
+	s.log().debug("Listening for client STREAM signal")
 	msg, err := readMessage(s.conn, readTimeOut)
 	if err != nil {
 		s.handleReadError(err, "fail to read status STREAM")
@@ -206,22 +268,38 @@ func (s *state) listenStream() {
 }
 
 func (s *state) stream() {
+	channel := s.process.User().Channel()
+	aborted := false
 	err := s.process.Stream(
 		bufSize,
 		func(buf []byte) {
+			// The file can't stop being read, so skip the rest of it
+			if aborted || s.status.isAborted() {
+				aborted = true
+				return
+			}
+			if !s.throttle.wait(process.ActionDownload, channel, len(buf), s.status.isAborted) {
+				aborted = true
+				return
+			}
 			_, err := s.conn.Write(buf)
 			if err != nil {
 				// TODO Fix StreamLocalFile paradigm
 				s.error("Fail to write chunk")
 				return
 			}
+			s.onTransferred(process.ActionDownload, len(buf))
 		},
 	)
 	if err != nil {
 		s.error("fail to stream file: " + err.Error())
 		return
 	}
-	log.Println("File sent to client, waiting for client state EOF")
+	if aborted {
+		s.error(errTransferAborted.Error())
+		return
+	}
+	s.log().debug("File sent to client, waiting for client state EOF")
 	msg, err := readMessage(s.conn, readTimeOut)
 	if err != nil {
 		s.error("Server error, fail to read state=EOF")
@@ -232,26 +310,189 @@ func (s *state) stream() {
 		return
 	}
 
-	log.Println("Sending state DONE")
+	s.log().debug("Sending state DONE")
 	err = writeState(process.Done, s.conn)
 	if err != nil {
 		s.error("Fail to write state=DONE")
 		return
 	}
+	s.endTransfer(nil)
+	s.svc.hooks.OnDownloadCompleted(s.client(), s.hookFile())
 }
 
 func (s *state) handleReadError(err error, msg string) {
 	if err == io.EOF {
-		log.Println("Communication closed by the client")
+		s.log().info("Communication closed by the client")
 		s.quit()
 		return
 	}
-	log.Println(msg, err)
+	s.log().warn(msg, "err", err)
 	s.error(msg)
 }
 
 func (s *state) error(msg string) {
-	log.Println("ERROR:", msg)
+	s.log().warn("Process error", "reason", msg)
+	s.svc.metrics.error(msg)
+	s.endTransfer(errors.New(msg))
 	s.process.Error()
+	s.syncStatus()
 	writeErrorState(msg, s.conn)
 }
+
+func (s *state) beginTransfer() {
+	user := s.process.User()
+	info := TransferInfo{
+		ID:      s.status.readLastTransfer(),
+		Action:  actionLabel(s.process.Action()),
+		Channel: user.Channel().Name,
+		File:    user.FileInfo().Value,
+		Size:    user.FileInfo().Size,
+		Bytes:   0,
+		Started: time.Now(),
+	}
+	s.status.begin(info)
+	s.tracker.reset(info.Started)
+	s.svc.metrics.transferStarted(s.process.Action())
+	s.progress(newProgressPayload(ProgressStarted, info))
+}
+
+func (s *state) onTransferred(action process.Action, n int) {
+	info := s.status.add(n)
+	s.svc.metrics.transferred(action, n)
+	if _, ok := s.tracker.next(info, time.Now()); ok {
+		s.progress(newProgressPayload(ProgressPercent, info))
+	}
+}
+
+// Records the end of the current transfer, if any, which failed iff err is not
+// nil. It's safe to call it more than once.
+func (s *state) endTransfer(err error) {
+	info, ok := s.status.end()
+	if !ok {
+		return
+	}
+	s.svc.metrics.transferEnded(s.process.Action(), time.Since(info.Started))
+	outcome, msg := auditOutcome(err)
+	s.audit(AuditEntry{
+		Action:  auditTransferAction(s.process.Action()),
+		Channel: info.Channel,
+		File:    info.File,
+		Size:    info.Bytes,
+		Outcome: outcome,
+		Error:   msg,
+	})
+	event := ProgressCompleted
+	if err != nil {
+		event = ProgressFailed
+	}
+	p := newProgressPayload(event, info)
+	p.Error = msg
+	s.progress(p)
+}
+
+// Records a transfer that was not accepted.
+func (s *state) auditRejected(payload process.StartPayload, err error) {
+	s.audit(AuditEntry{
+		Action:  auditTransferAction(payload.Action),
+		Channel: payload.Channel.Name,
+		File:    payload.FileInfo.Value,
+		Size:    payload.Size,
+		Outcome: AuditFailure,
+		Error:   err.Error(),
+	})
+}
+
+func auditTransferAction(action process.Action) AuditAction {
+	if action == process.ActionDownload {
+		return AuditDownload
+	}
+	return AuditUpload
+}
+
+// Runs the pre-hook of the action requested, which can veto it.
+func (s *state) startHook(payload process.StartPayload) error {
+	f := hooks.File{
+		Channel: payload.Channel.Name,
+		Path:    payload.FileInfo.Value,
+		Size:    payload.Size,
+	}
+	switch payload.Action {
+	case process.ActionUpload:
+		return s.svc.hooks.OnUploadStarted(s.client(), f)
+	case process.ActionDownload:
+		return s.svc.hooks.OnDownloadStarted(s.client(), f)
+	}
+	return nil
+}
+
+func (s *state) hookFile() hooks.File {
+	user := s.process.User()
+	return hooks.File{
+		Channel: user.Channel().Name,
+		Path:    user.FileInfo().Value,
+		Size:    user.FileInfo().Size,
+	}
+}
+
+// Records the client that uploaded the file, which is kept with its version
+// when the file is replaced.
+func (s *state) recordUploader() {
+	user := s.process.User()
+	err := s.svc.versions.uploaded(
+		user.Channel(),
+		user.FileInfo().Value,
+		user.FileInfo().Size,
+		s.client(),
+	)
+	if err != nil {
+		s.log().error("Fail to record file uploader", "err", err)
+	}
+}
+
+// Adds the metadata given in the StartPayload to the file uploaded.
+func (s *state) storeMeta() {
+	if s.meta.isEmpty() {
+		return
+	}
+	user := s.process.User()
+	_, err := s.svc.meta.set(user.Channel(), user.FileInfo().Value, s.meta)
+	if err != nil {
+		s.log().error("Fail to store file metadata", "err", err)
+	}
+}
+
+// Stores the content of the file uploaded as a blob, if deduplication is
+// enabled.
+func (s *state) storeBlob() {
+	err := s.svc.blobs.store(s.process.User().File().Path())
+	if err != nil {
+		s.log().error("Fail to store file blob", "err", err)
+	}
+}
+
+// Returns the change done by the upload completed.
+func (s *state) uploadChange() UpdatePayload {
+	user := s.process.User()
+	t := ChangeFileAdded
+	if user.Replaced() {
+		t = ChangeFileReplaced
+	}
+	u := newChange(t, user.Channel().Name, user.FileInfo().Value, user.FileInfo().Size)
+	u.CID = s.client().CID
+	if info, err := os.Stat(user.File().Path()); err == nil {
+		u.ModTime = info.ModTime()
+	}
+	return u
+}
+
+func (s *state) syncStatus() {
+	s.status.setState(s.process.State())
+}
+
+// Returns the logger with the context of the client and the current transfer.
+func (s *state) log() logger {
+	if s.status.readLastTransfer() == 0 {
+		return s.logger()
+	}
+	return s.logger().with("file", s.process.User().File().Value)
+}
@@ -0,0 +1,218 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"fs/process"
+	"sync"
+	"time"
+)
+
+type TransferInfo struct {
+	ID      uint64
+	CID     uint
+	Action  string
+	Channel string
+	File    string
+	Size    uint64
+	Bytes   uint64
+	Percent int
+	Started time.Time
+}
+
+// session Describes the activity of the client since it connected.
+type session struct {
+	Connected    time.Time
+	Bytes        uint64 // Bytes moved by all the transfers
+	LastActivity time.Time
+}
+
+// status Keeps a copy of the client process state, its current transfer and
+// its session, so they can be read from other goroutines, like the Hub.
+type status struct {
+	mu       sync.Mutex
+	state    process.State
+	transfer TransferInfo
+	last     uint64 // ID of the last transfer started, 0 if none
+	active   bool
+	aborted  bool // Whether an admin requested to abort the transfer
+	session  session
+	profile  Profile
+	channel  process.Channel // Current channel, the last one subscribed
+	admin    bool            // Whether the client was granted admin privileges
+	// Channels the client is subscribed to
+	subscriptions []string
+}
+
+func newStatus() *status {
+	now := time.Now()
+	return &status{
+		state:         process.Start,
+		session:       session{Connected: now, LastActivity: now},
+		subscriptions: make([]string, 0),
+	}
+}
+
+// Records that the client did something, like sending a message.
+func (s *status) touch() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.session.LastActivity = time.Now()
+}
+
+func (s *status) setState(state process.State) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = state
+}
+
+// Records the ID of the transfer requested, before it's accepted.
+func (s *status) setLastTransfer(id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.last = id
+}
+
+func (s *status) readLastTransfer() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
+
+func (s *status) begin(info TransferInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.transfer = info
+	s.active = true
+	s.aborted = false
+}
+
+// Adds the bytes transferred and returns the updated transfer.
+func (s *status) add(n int) TransferInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.transfer.Bytes += uint64(n)
+	s.session.Bytes += uint64(n)
+	s.session.LastActivity = time.Now()
+	return s.transfer
+}
+
+// Ends the transfer and returns it, or false if there was no active transfer.
+func (s *status) end() (TransferInfo, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.active {
+		return TransferInfo{}, false
+	}
+	s.active = false
+	return s.transfer, true
+}
+
+// Marks the transfer with the given ID to be aborted, or returns false if it's
+// not the active transfer.
+func (s *status) abort(id uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.active || s.transfer.ID != id {
+		return false
+	}
+	s.aborted = true
+	return true
+}
+
+func (s *status) isAborted() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active && s.aborted
+}
+
+func (s *status) read() (process.State, TransferInfo, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state, s.transfer, s.active
+}
+
+func (s *status) readSession() session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.session
+}
+
+func (s *status) setProfile(profile Profile) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.profile = profile
+}
+
+func (s *status) readProfile() Profile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.profile
+}
+
+func (s *status) readChannel() process.Channel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.channel
+}
+
+func (s *status) grantAdmin() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.admin = true
+}
+
+func (s *status) isAdmin() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.admin
+}
+
+// Adds the channel to the subscriptions of the client and makes it its current
+// channel, or returns false if it was already subscribed.
+func (s *status) subscribe(channel process.Channel) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.channel = channel
+	for _, name := range s.subscriptions {
+		if name == channel.Name {
+			return false
+		}
+	}
+	s.subscriptions = append(s.subscriptions, channel.Name)
+	return true
+}
+
+// Removes the channel from the subscriptions of the client, or returns false
+// if it wasn't subscribed. If it was its current channel, the last one
+// subscribed becomes the current channel.
+func (s *status) unsubscribe(channel process.Channel) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, name := range s.subscriptions {
+		if name != channel.Name {
+			continue
+		}
+		s.subscriptions = append(s.subscriptions[:i], s.subscriptions[i+1:]...)
+		if s.channel.Name == channel.Name {
+			s.channel = process.Channel{}
+			if n := len(s.subscriptions); n > 0 {
+				s.channel = process.NewChannel(s.subscriptions[n-1])
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Returns the channels the client is subscribed to, in the order they were
+// subscribed.
+func (s *status) readSubscriptions() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]string, len(s.subscriptions))
+	copy(list, s.subscriptions)
+	return list
+}
@@ -0,0 +1,50 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"fs/process"
+	"testing"
+)
+
+func TestStatusAbort(t *testing.T) {
+	s := newStatus()
+	if s.abort(1) {
+		t.Fatal("Aborted without an active transfer")
+	}
+	s.begin(TransferInfo{ID: 1})
+	if s.abort(2) {
+		t.Fatal("Aborted a transfer with a different ID")
+	}
+	if s.isAborted() {
+		t.Fatal("Transfer must not be aborted yet")
+	}
+	if !s.abort(1) || !s.isAborted() {
+		t.Fatal("Fail to abort the active transfer")
+	}
+	s.end()
+	s.begin(TransferInfo{ID: 2})
+	if s.isAborted() {
+		t.Fatal("Abort must not apply to the next transfer")
+	}
+}
+
+func TestStatusSubscriptions(t *testing.T) {
+	s := newStatus()
+	s.subscribe(process.NewChannel("main"))
+	s.subscribe(process.NewChannel("test"))
+	if s.subscribe(process.NewChannel("main")) {
+		t.Fatal("Channel subscribed twice")
+	}
+	if s.readChannel().Name != "main" {
+		t.Fatal("Last channel subscribed must be the current one")
+	}
+	if !s.unsubscribe(process.NewChannel("main")) || s.readChannel().Name != "test" {
+		t.Fatal("Last channel left must become the current one")
+	}
+	if !s.unsubscribe(process.NewChannel("test")) || s.readChannel().Name != "" {
+		t.Fatal("No channel must be current after leaving all of them")
+	}
+}
@@ -10,7 +10,8 @@ import (
 )
 
 const (
-	fsRoot = ".fs"
+	fsRoot   = ".fs"
+	dataRoot = ".fs-data" // Server state that is not part of the FS
 )
 
 func getFsRootFile() (fs.OsFile, error) {
@@ -29,3 +30,11 @@ func getOsFsRoot() (string, error) {
 	}
 	return path + fs.Separator + fsRoot, nil
 }
+
+func getOsDataRoot() (string, error) {
+	path, err := files.GetExecPath()
+	if err != nil {
+		return "", err
+	}
+	return path + fs.Separator + dataRoot, nil
+}
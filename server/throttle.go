@@ -0,0 +1,336 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"errors"
+	"fs/process"
+	"sync"
+	"time"
+)
+
+type RateScope string
+
+const (
+	ScopeConnection RateScope = "CONNECTION"
+	ScopeChannel    RateScope = "CHANNEL"
+	ScopeGlobal     RateScope = "GLOBAL"
+)
+
+// rates Defines a rate in bytes per second for each process.Action, where zero
+// means unlimited. ActionUpload limits DATA and ActionDownload limits STREAM.
+type rates [2]int64
+
+func newRates(rate int64) rates {
+	return rates{rate, rate}
+}
+
+// Sets the given rate to the action, or to all of them if action is nil.
+func (r *rates) set(action *process.Action, rate int64) {
+	if action == nil {
+		*r = newRates(rate)
+		return
+	}
+	r[*action] = rate
+}
+
+// tokenBucket Limits the number of bytes per second that can be transferred.
+// Tokens can be taken in advance, so the bucket keeps a debt that delays the
+// next reservations.
+type tokenBucket struct {
+	mu       sync.Mutex
+	rate     int64 // Zero means unlimited
+	minBurst int64
+	tokens   float64
+	last     time.Time
+}
+
+// Returns a bucket of bytes, so it holds at least one chunk.
+func newTokenBucket(rate int64) *tokenBucket {
+	return newTokenBucketWithBurst(rate, bufSize)
+}
+
+func newTokenBucketWithBurst(rate int64, minBurst int64) *tokenBucket {
+	b := &tokenBucket{minBurst: minBurst, last: time.Now()}
+	b.setRate(rate)
+	return b
+}
+
+func (b *tokenBucket) setRate(rate int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.rate = rate
+	b.tokens = float64(b.burst())
+}
+
+// Takes n tokens and returns how long the caller has to wait until they're
+// actually available.
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+}
+
+// Takes n tokens iff they're available right now.
+func (b *tokenBucket) take(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return true
+	}
+	b.refill(time.Now())
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	b.last = now
+	b.tokens += elapsed * float64(b.rate)
+	if max := float64(b.burst()); b.tokens > max {
+		b.tokens = max
+	}
+}
+
+// A bucket holds one second of tokens, and at least its min burst.
+func (b *tokenBucket) burst() int64 {
+	if b.rate < b.minBurst {
+		return b.minBurst
+	}
+	return b.rate
+}
+
+// throttle Keeps the bandwidth limits of the server for each connection, each
+// channel and the whole server. The limits can be changed at runtime.
+type throttle struct {
+	mu               sync.Mutex
+	connectionRates  rates
+	channelRates     rates
+	channelOverrides map[string]rates
+	global           [2]*tokenBucket
+	channels         map[string]*[2]*tokenBucket
+	connections      map[*connThrottle]struct{}
+}
+
+func newThrottle(cfg config) *throttle {
+	global := newRates(cfg.globalRate)
+	return &throttle{
+		connectionRates:  newRates(cfg.connectionRate),
+		channelRates:     newRates(cfg.channelRate),
+		channelOverrides: make(map[string]rates),
+		global: [2]*tokenBucket{
+			newTokenBucket(global[process.ActionUpload]),
+			newTokenBucket(global[process.ActionDownload]),
+		},
+		channels:    make(map[string]*[2]*tokenBucket),
+		connections: make(map[*connThrottle]struct{}),
+	}
+}
+
+// Returns the throttle for a new connection. It must be released when the
+// connection ends.
+func (t *throttle) connect() *connThrottle {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c := &connThrottle{
+		throttle: t,
+		buckets: [2]*tokenBucket{
+			newTokenBucket(t.connectionRates[process.ActionUpload]),
+			newTokenBucket(t.connectionRates[process.ActionDownload]),
+		},
+		wake:    make(chan struct{}, 1),
+		stopped: make(chan struct{}),
+	}
+	t.connections[c] = struct{}{}
+	return c
+}
+
+func (t *throttle) release(c *connThrottle) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.connections, c)
+}
+
+// Sets the rate of the given scope. The channel is only read for the channel
+// scope, where an empty channel sets the default rate of all the channels.
+func (t *throttle) set(
+	scope RateScope,
+	action *process.Action,
+	channel process.Channel,
+	rate int64,
+) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch scope {
+	case ScopeConnection:
+		t.connectionRates.set(action, rate)
+		for c := range t.connections {
+			c.setRates(t.connectionRates)
+		}
+	case ScopeChannel:
+		t.setChannelRate(action, channel, rate)
+	case ScopeGlobal:
+		for i, b := range t.global {
+			if action == nil || *action == process.Action(i) {
+				b.setRate(rate)
+			}
+		}
+	default:
+		return errors.New("invalid rate limit scope")
+	}
+	// The waits in progress were computed with the previous rates
+	for c := range t.connections {
+		c.interrupt()
+	}
+	return nil
+}
+
+func (t *throttle) setChannelRate(
+	action *process.Action,
+	channel process.Channel,
+	rate int64,
+) {
+	if channel.Name == "" {
+		t.channelRates.set(action, rate)
+	} else {
+		r, ok := t.channelOverrides[channel.Name]
+		if !ok {
+			r = t.channelRates
+		}
+		r.set(action, rate)
+		t.channelOverrides[channel.Name] = r
+	}
+	for name, buckets := range t.channels {
+		r := t.channelRatesOf(name)
+		for i, b := range buckets {
+			b.setRate(r[i])
+		}
+	}
+}
+
+func (t *throttle) channelRatesOf(name string) rates {
+	if r, ok := t.channelOverrides[name]; ok {
+		return r
+	}
+	return t.channelRates
+}
+
+func (t *throttle) channelBuckets(channel process.Channel) *[2]*tokenBucket {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	buckets, ok := t.channels[channel.Name]
+	if !ok {
+		r := t.channelRatesOf(channel.Name)
+		buckets = &[2]*tokenBucket{newTokenBucket(r[0]), newTokenBucket(r[1])}
+		t.channels[channel.Name] = buckets
+	}
+	return buckets
+}
+
+// Drops the buckets and the rates of the channel, so the ones of the deleted
+// channels are not kept forever. A channel created later with the same name
+// starts with the default rates.
+func (t *throttle) removeChannel(channel process.Channel) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.channels, channel.Name)
+	delete(t.channelOverrides, channel.Name)
+}
+
+// connThrottle Limits the bandwidth of a connection.
+type connThrottle struct {
+	throttle *throttle
+	buckets  [2]*tokenBucket
+	wake     chan struct{} // Wakes up the wait in progress
+	stopped  chan struct{} // Closed when the connection ends
+	stopOnce sync.Once
+}
+
+func (c *connThrottle) release() {
+	c.stop()
+	c.throttle.release(c)
+}
+
+// Wakes up the wait in progress, if any, so it checks whether it was cancelled
+// and recomputes its delay.
+func (c *connThrottle) interrupt() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Ends the wait in progress, and the next ones don't wait anymore, as the
+// connection is closing.
+func (c *connThrottle) stop() {
+	c.stopOnce.Do(func() {
+		close(c.stopped)
+	})
+}
+
+func (c *connThrottle) setRates(r rates) {
+	for i, b := range c.buckets {
+		b.setRate(r[i])
+	}
+}
+
+// Blocks until n bytes can be transferred for the given action on the given
+// channel, according to the connection, channel and global limits. It returns
+// false if the connection is stopped or cancelled returns true meanwhile.
+func (c *connThrottle) wait(
+	action process.Action,
+	channel process.Channel,
+	n int,
+	cancelled func() bool,
+) bool {
+	channelBuckets := c.throttle.channelBuckets(channel)
+	buckets := [3]*tokenBucket{
+		c.buckets[action],
+		channelBuckets[action],
+		c.throttle.global[action],
+	}
+	delay := reserve(buckets, n)
+	for delay > 0 {
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+			return true
+		case <-c.stopped:
+			timer.Stop()
+			return false
+		case <-c.wake:
+			timer.Stop()
+			if cancelled() {
+				return false
+			}
+			// Only the debt left is waited, which the new rates may have paid
+			delay = reserve(buckets, 0)
+		}
+	}
+	return true
+}
+
+// Takes n tokens of each bucket and returns the longest delay.
+func reserve(buckets [3]*tokenBucket, n int) time.Duration {
+	delay := time.Duration(0)
+	for _, b := range buckets {
+		if d := b.reserve(n); d > delay {
+			delay = d
+		}
+	}
+	return delay
+}
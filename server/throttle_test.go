@@ -0,0 +1,119 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"fs/process"
+	"fs/utils"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	unlimited := newTokenBucket(0)
+	if unlimited.reserve(1_000_000) != 0 {
+		t.Fatal("Unlimited bucket must not delay")
+	}
+
+	b := newTokenBucket(2 * bufSize)
+	if b.reserve(2*bufSize) != 0 {
+		t.Fatal("Burst must be available right away")
+	}
+	delay := b.reserve(bufSize)
+	if delay < 400*time.Millisecond || delay > 500*time.Millisecond {
+		t.Fatal("Wrong delay after consuming the burst:", delay)
+	}
+}
+
+func TestThrottleSet(t *testing.T) {
+	th := newThrottle(config{connectionRate: bufSize})
+	conn := th.connect()
+	defer conn.release()
+	upload := process.ActionUpload
+
+	err := th.set(ScopeConnection, &upload, process.Channel{}, 0)
+	utils.RequirePassCase(t, err, "Fail to set connection rate")
+	if conn.buckets[process.ActionUpload].rate != 0 {
+		t.Fatal("Connection upload rate was not updated")
+	}
+	if conn.buckets[process.ActionDownload].rate != bufSize {
+		t.Fatal("Connection download rate must not change")
+	}
+
+	channel := process.NewChannel(testChannel)
+	err = th.set(ScopeChannel, nil, channel, 10)
+	utils.RequirePassCase(t, err, "Fail to set channel rate")
+	if th.channelBuckets(channel)[process.ActionDownload].rate != 10 {
+		t.Fatal("Channel rate was not set")
+	}
+	if th.channelBuckets(process.NewChannel("main"))[0].rate != 0 {
+		t.Fatal("Other channels must keep the default rate")
+	}
+
+	err = th.set("INVALID", nil, channel, 10)
+	utils.RequireFailureCase(t, err, "Invalid scope must fail")
+}
+
+func TestThrottleRemoveChannel(t *testing.T) {
+	th := newThrottle(config{})
+	channel := process.NewChannel(testChannel)
+	_ = th.set(ScopeChannel, nil, channel, 10)
+	th.channelBuckets(channel)
+	th.channelBuckets(process.NewChannel("main"))
+
+	th.removeChannel(channel)
+	if _, ok := th.channels[testChannel]; ok {
+		t.Fatal("Buckets of the deleted channel must be dropped")
+	}
+	if _, ok := th.channelOverrides[testChannel]; ok {
+		t.Fatal("Rates of the deleted channel must be dropped")
+	}
+	if len(th.channels) != 1 {
+		t.Fatal("Buckets of the other channels must be kept")
+	}
+}
+
+func TestThrottleWaitInterrupted(t *testing.T) {
+	th := newThrottle(config{connectionRate: bufSize})
+	conn := th.connect()
+	channel := process.NewChannel(testChannel)
+	upload := process.ActionUpload
+	notCancelled := func() bool { return false }
+
+	// Lifting the limit ends the wait of a chunk that would take 10 seconds
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_ = th.set(ScopeConnection, &upload, process.Channel{}, 0)
+	}()
+	start := time.Now()
+	if !conn.wait(upload, channel, 11*bufSize, notCancelled) {
+		t.Fatal("Wait must not be cancelled by a rate change")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("Wait must be recomputed when the rate changes")
+	}
+
+	// The abort is checked when the wait is interrupted
+	download := process.ActionDownload
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		conn.interrupt()
+	}()
+	if conn.wait(download, channel, 11*bufSize, func() bool { return true }) {
+		t.Fatal("Cancelled wait must return false")
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		conn.release()
+	}()
+	start = time.Now()
+	if conn.wait(download, channel, 11*bufSize, notCancelled) {
+		t.Fatal("Wait must end when the connection is stopped")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("Wait must not sleep the whole delay")
+	}
+}
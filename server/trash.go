@@ -0,0 +1,227 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fs"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	trashDir           = "trash"
+	trashIndexFile     = "trash.json"
+	trashContent       = "content"   // The channel or file deleted
+	trashVersions      = "versions"  // The versions of the files of a channel
+	trashMeta          = "meta.json" // The metadata of the files of a channel
+	trashPurgeInterval = time.Hour
+)
+
+var errTrashItemNotFound = errors.New("trash item not found")
+
+// TrashItem Describes a channel or file deleted, and the client that deleted
+// it.
+type TrashItem struct {
+	ID      uint64
+	Channel string
+	File    string `json:",omitempty"` // Empty if the whole channel was deleted
+	Size    uint64
+	Meta    FileMeta // Metadata of the file deleted
+	Deleted time.Time
+	CID     uint
+	User    string `json:",omitempty"` // Set instead of the CID, e.g. "admin-api"
+	Address string
+}
+
+// trash Keeps the channels and files deleted into the data root, so they can
+// be restored until they're purged after the retention period. The content of
+// each item is kept at trash/{id}.
+type trash struct {
+	mu        sync.Mutex
+	dir       string
+	retention time.Duration // How long the items are kept, forever if 0
+	log       logger
+	Last      uint64 // ID of the last item
+	Items     []TrashItem
+}
+
+func newTrash(osDataRoot string, retention time.Duration, log logger) (*trash, error) {
+	t := &trash{
+		dir:       osDataRoot + fs.Separator + trashDir,
+		retention: retention,
+		log:       log,
+		Items:     make([]TrashItem, 0),
+	}
+	err := os.MkdirAll(t.dir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(t.dir + fs.Separator + trashIndexFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, t)
+	return t, err
+}
+
+// Purges the expired items in the background.
+func (t *trash) start() {
+	if t.retention <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(trashPurgeInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			t.purge(now)
+		}
+	}()
+}
+
+// Moves the content at the path into a new item of the trash, and returns the
+// item with its ID.
+func (t *trash) put(item TrashItem, path string) (TrashItem, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	item.ID = t.Last + 1
+	item.Deleted = time.Now()
+	dir := t.itemDir(item.ID)
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return item, err
+	}
+	err = os.Rename(path, dir+fs.Separator+trashContent)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return item, err
+	}
+	t.Last = item.ID
+	t.Items = append(t.Items, item)
+	return item, t.save()
+}
+
+// Runs the restore of the item with the given ID, which moves its content out
+// of the item directory, and drops the item if it succeeds.
+func (t *trash) restore(id uint64, f func(item TrashItem, dir string) error) (TrashItem, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	i, ok := t.find(id)
+	if !ok {
+		return TrashItem{}, errTrashItemNotFound
+	}
+	item := t.Items[i]
+	err := f(item, t.itemDir(id))
+	if err != nil {
+		return item, err
+	}
+	return item, t.drop(i)
+}
+
+// Returns the items of the channel, or all of them if it's empty.
+func (t *trash) list(channel string) []TrashItem {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := make([]TrashItem, 0)
+	for _, item := range t.Items {
+		if channel == "" || item.Channel == channel {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// Deletes for good the items of the channel, or all of them if it's empty,
+// and returns how many were deleted.
+func (t *trash) empty(channel string) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.dropIf(func(item TrashItem) bool {
+		return channel == "" || item.Channel == channel
+	})
+}
+
+// Deletes for good the items kept longer than the retention period.
+func (t *trash) purge(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n, err := t.dropIf(func(item TrashItem) bool {
+		return now.Sub(item.Deleted) >= t.retention
+	})
+	if err != nil {
+		t.log.error("Fail to purge trash", "err", err)
+	}
+	if n > 0 {
+		t.log.info("Trash purged", "items", n)
+	}
+}
+
+// Returns the directory of the item with the given ID.
+func (t *trash) itemDir(id uint64) string {
+	return t.dir + fs.Separator + strconv.FormatUint(id, 10)
+}
+
+// Deletes the items that match, and returns how many were deleted. It must be
+// called with the lock held.
+func (t *trash) dropIf(match func(item TrashItem) bool) (int, error) {
+	kept := make([]TrashItem, 0, len(t.Items))
+	n := 0
+	var err error
+	for _, item := range t.Items {
+		if !match(item) {
+			kept = append(kept, item)
+			continue
+		}
+		if rmErr := os.RemoveAll(t.itemDir(item.ID)); rmErr != nil {
+			err = rmErr
+			kept = append(kept, item)
+			continue
+		}
+		n++
+	}
+	if n == 0 {
+		return 0, err
+	}
+	t.Items = kept
+	if saveErr := t.save(); saveErr != nil {
+		err = saveErr
+	}
+	return n, err
+}
+
+// Deletes the item at the given index. It must be called with the lock held.
+func (t *trash) drop(i int) error {
+	err := os.RemoveAll(t.itemDir(t.Items[i].ID))
+	if err != nil {
+		return err
+	}
+	t.Items = append(t.Items[:i], t.Items[i+1:]...)
+	return t.save()
+}
+
+func (t *trash) find(id uint64) (int, bool) {
+	for i, item := range t.Items {
+		if item.ID == id {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// Persists the index of the trash. It must be called with the lock held.
+func (t *trash) save() error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(t.dir+fs.Separator+trashIndexFile, data, 0644)
+}
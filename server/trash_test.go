@@ -0,0 +1,60 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"fs"
+	"fs/utils"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTrash(t *testing.T) {
+	dataRoot := t.TempDir()
+	root := t.TempDir()
+	bin, err := newTrash(dataRoot, time.Hour, logger{})
+	utils.RequirePassCase(t, err, "Fail to create trash")
+	path := root + fs.Separator + "doc.txt"
+
+	for _, channel := range []string{"test", "main"} {
+		utils.RequirePassCase(t, ioutil.WriteFile(path, []byte("doc"), 0644), "Fail to write file")
+		_, err = bin.put(TrashItem{Channel: channel, File: "doc.txt", Size: 3}, path)
+		utils.RequirePassCase(t, err, "Fail to put file into trash")
+		if _, err = os.Stat(path); !os.IsNotExist(err) {
+			t.Fatal("File not moved to the trash")
+		}
+	}
+	if len(bin.list("")) != 2 || len(bin.list("test")) != 1 {
+		t.Fatal("Wrong trash items:", bin.list(""))
+	}
+
+	// The items are kept after a restart
+	bin, err = newTrash(dataRoot, time.Hour, logger{})
+	utils.RequirePassCase(t, err, "Fail to reload trash")
+	item, err := bin.restore(1, func(item TrashItem, dir string) error {
+		return os.Rename(dir+fs.Separator+trashContent, path)
+	})
+	utils.RequirePassCase(t, err, "Fail to restore item")
+	if data, _ := ioutil.ReadFile(path); item.Channel != "test" || string(data) != "doc" {
+		t.Fatal("Item not restored:", item)
+	}
+	if _, err = bin.restore(1, nil); err != errTrashItemNotFound {
+		t.Fatal("Restored item must be removed from the trash")
+	}
+
+	bin.purge(time.Now())
+	if len(bin.list("")) != 1 {
+		t.Fatal("Item purged before the retention period")
+	}
+	bin.purge(time.Now().Add(time.Hour))
+	if len(bin.list("")) != 0 {
+		t.Fatal("Item not purged after the retention period")
+	}
+	if _, err = os.Stat(bin.itemDir(2)); !os.IsNotExist(err) {
+		t.Fatal("Purged item content not deleted")
+	}
+}
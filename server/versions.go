@@ -0,0 +1,342 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fs"
+	"fs/files"
+	"fs/hooks"
+	"fs/process"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	versionsDir      = "versions"
+	versionIndexFile = "versions.json"
+	restoreTmpFile   = "restore.tmp"
+)
+
+var errVersionNotFound = errors.New("version not found")
+
+// FileVersion Describes a previous content of a file, and the client that
+// uploaded it.
+type FileVersion struct {
+	Version  uint
+	Size     uint64
+	Uploaded time.Time // When the content was uploaded
+	Replaced time.Time // When another upload replaced it
+	CID      uint
+	Address  string
+}
+
+// versionIndex The versions of a file, persisted next to their contents.
+type versionIndex struct {
+	Last     uint        // Number of the last version kept
+	Current  FileVersion // Upload of the current content
+	Versions []FileVersion
+}
+
+// versionStore Keeps the previous contents of the files replaced by uploads
+// into the data root, up to a max number of versions per file. The contents of
+// a file are kept at versions/{channel}/{file}/{version}.
+type versionStore struct {
+	mu  sync.Mutex
+	dir string
+	max int // Max number of versions kept per file, none if 0
+}
+
+func newVersionStore(osDataRoot string, max int) (*versionStore, error) {
+	dir := osDataRoot + fs.Separator + versionsDir
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	return &versionStore{dir: dir, max: max}, nil
+}
+
+// Keep Moves the content of the file about to be replaced into a new version,
+// dropping the oldest ones above the max.
+func (v *versionStore) Keep(channel process.Channel, path string, file fs.OsFile) error {
+	if v.max <= 0 {
+		return nil
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	dir, err := v.fileDir(channel, path)
+	if err != nil {
+		return err
+	}
+	index, err := v.readIndex(dir)
+	if err != nil {
+		return err
+	}
+	err = v.keep(dir, &index, file)
+	if err != nil {
+		return err
+	}
+	return v.writeIndex(dir, index)
+}
+
+// File Returns the file with the content of the given version.
+func (v *versionStore) File(channel process.Channel, path string, version uint) (fs.OsFile, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	dir, err := v.fileDir(channel, path)
+	if err != nil {
+		return fs.OsFile{}, err
+	}
+	index, err := v.readIndex(dir)
+	if err != nil {
+		return fs.OsFile{}, err
+	}
+	if _, ok := index.find(version); !ok {
+		return fs.OsFile{}, errVersionNotFound
+	}
+	return versionFile(dir, version), nil
+}
+
+// Records the client that uploaded the current content of the file, so it's
+// kept along with its version when it gets replaced.
+func (v *versionStore) uploaded(
+	channel process.Channel,
+	path string,
+	size uint64,
+	client hooks.Client,
+) error {
+	if v.max <= 0 {
+		return nil
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	dir, err := v.fileDir(channel, path)
+	if err != nil {
+		return err
+	}
+	index, err := v.readIndex(dir)
+	if err != nil {
+		return err
+	}
+	index.Current = FileVersion{
+		Size:     size,
+		Uploaded: time.Now(),
+		CID:      client.CID,
+		Address:  client.Address,
+	}
+	return v.writeIndex(dir, index)
+}
+
+// Returns the versions kept of the file, oldest first.
+func (v *versionStore) list(channel process.Channel, path string) ([]FileVersion, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	dir, err := v.fileDir(channel, path)
+	if err != nil {
+		return nil, err
+	}
+	index, err := v.readIndex(dir)
+	return index.Versions, err
+}
+
+// Copies the content of the version into the file, keeping its current
+// content as a new version first, so the restore can be undone.
+func (v *versionStore) restore(
+	channel process.Channel,
+	path string,
+	version uint,
+	file fs.OsFile,
+	client hooks.Client,
+) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	dir, err := v.fileDir(channel, path)
+	if err != nil {
+		return err
+	}
+	index, err := v.readIndex(dir)
+	if err != nil {
+		return err
+	}
+	restored, ok := index.find(version)
+	if !ok {
+		return errVersionNotFound
+	}
+	// Copy the version first, as keeping the current content may drop it
+	tmp := dir.Path() + fs.Separator + restoreTmpFile
+	err = copyFile(versionFile(dir, version).Path(), tmp)
+	if err != nil {
+		return err
+	}
+	exists, err := files.Exists(file)
+	if err == nil && exists {
+		err = v.keep(dir, &index, file)
+	}
+	if err == nil {
+		err = os.Rename(tmp, file.Path())
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	index.Current = FileVersion{
+		Size:     restored.Size,
+		Uploaded: time.Now(),
+		CID:      client.CID,
+		Address:  client.Address,
+	}
+	return v.writeIndex(dir, index)
+}
+
+// Moves the versions of the files of the channel to the path, if it has any.
+func (v *versionStore) moveChannel(channel process.Channel, path string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	dir, err := v.channelDir(channel)
+	if err != nil {
+		return err
+	}
+	return renameIfExists(dir.Path(), path)
+}
+
+// Moves back the versions of the files of the channel from the path, if there
+// are any.
+func (v *versionStore) restoreChannel(channel process.Channel, path string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	dir, err := v.channelDir(channel)
+	if err != nil {
+		return err
+	}
+	return renameIfExists(path, dir.Path())
+}
+
+// Moves the file into a new version of the index. It must be called with the
+// lock held.
+func (v *versionStore) keep(dir fs.OsFile, index *versionIndex, file fs.OsFile) error {
+	info, err := os.Stat(file.Path())
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dir.Path(), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	version := index.Current
+	if version.Uploaded.IsZero() {
+		// Uploaded before the versions were kept
+		version = FileVersion{Uploaded: info.ModTime()}
+	}
+	index.Last++
+	version.Version = index.Last
+	version.Size = uint64(info.Size())
+	version.Replaced = time.Now()
+	err = os.Rename(file.Path(), versionFile(dir, version.Version).Path())
+	if err != nil {
+		return err
+	}
+	index.Current = FileVersion{}
+	index.Versions = append(index.Versions, version)
+	for len(index.Versions) > v.max {
+		oldest := index.Versions[0]
+		err = os.Remove(versionFile(dir, oldest.Version).Path())
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		index.Versions = index.Versions[1:]
+	}
+	return nil
+}
+
+func (v *versionStore) channelDir(channel process.Channel) (fs.OsFile, error) {
+	file, err := channel.File()
+	if err != nil || channel.Name == "" {
+		return fs.OsFile{}, errors.New("invalid channel")
+	}
+	return file.ToOsFile(v.dir), nil
+}
+
+// Returns the directory that keeps the versions of the file of the channel.
+func (v *versionStore) fileDir(channel process.Channel, path string) (fs.OsFile, error) {
+	file, err := channel.File()
+	if err != nil || channel.Name == "" {
+		return fs.OsFile{}, errors.New("invalid channel")
+	}
+	err = file.Append(path)
+	if err != nil || path == "" {
+		return fs.OsFile{}, errors.New("invalid file")
+	}
+	return file.ToOsFile(v.dir), nil
+}
+
+func (v *versionStore) readIndex(dir fs.OsFile) (versionIndex, error) {
+	index := versionIndex{Versions: make([]FileVersion, 0)}
+	data, err := ioutil.ReadFile(dir.Path() + fs.Separator + versionIndexFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return index, nil
+	}
+	if err != nil {
+		return index, err
+	}
+	err = json.Unmarshal(data, &index)
+	return index, err
+}
+
+func (v *versionStore) writeIndex(dir fs.OsFile, index versionIndex) error {
+	err := os.MkdirAll(dir.Path(), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dir.Path()+fs.Separator+versionIndexFile, data, 0644)
+}
+
+func (i versionIndex) find(version uint) (FileVersion, bool) {
+	for _, v := range i.Versions {
+		if v.Version == version {
+			return v, true
+		}
+	}
+	return FileVersion{}, false
+}
+
+func versionFile(dir fs.OsFile, version uint) fs.OsFile {
+	file := dir.File
+	_ = file.Append(strconv.Itoa(int(version)))
+	return file.ToOsFile(dir.FsRoot)
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func renameIfExists(src string, dst string) error {
+	err := os.Rename(src, dst)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"fs"
+	"fs/hooks"
+	"fs/process"
+	"fs/utils"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestVersionStore(t *testing.T) {
+	root := t.TempDir()
+	versions, err := newVersionStore(t.TempDir(), 2)
+	utils.RequirePassCase(t, err, "Fail to create version store")
+	channel := process.NewChannel("test")
+	utils.RequirePassCase(t, os.Mkdir(root+fs.Separator+"test", os.ModePerm), "Fail to create channel")
+	f, _ := fs.NewFileFromString("test/doc.txt")
+	file := f.ToOsFile(root)
+	client := hooks.Client{CID: 7, Address: "127.0.0.1:5000"}
+
+	// Upload three times, replacing the file twice
+	for _, content := range []string{"one", "two", "three"} {
+		exists, _ := os.Stat(file.Path())
+		if exists != nil {
+			utils.RequirePassCase(t, versions.Keep(channel, "doc.txt", file), "Fail to keep version")
+		}
+		utils.RequirePassCase(t, ioutil.WriteFile(file.Path(), []byte(content), 0644), "Fail to write file")
+		utils.RequirePassCase(t, versions.uploaded(channel, "doc.txt", uint64(len(content)), client), "Fail to record uploader")
+	}
+	list, err := versions.list(channel, "doc.txt")
+	utils.RequirePassCase(t, err, "Fail to list versions")
+	if len(list) != 2 || list[0].Version != 1 || list[0].CID != 7 || list[1].Size != 3 {
+		t.Fatal("Wrong versions:", list)
+	}
+
+	utils.RequirePassCase(t, versions.restore(channel, "doc.txt", 1, file, client), "Fail to restore version")
+	if data, _ := ioutil.ReadFile(file.Path()); string(data) != "one" {
+		t.Fatal("Version not restored:", string(data))
+	}
+
+	// The restored content is kept and the oldest version is dropped
+	list, _ = versions.list(channel, "doc.txt")
+	if len(list) != 2 || list[0].Version != 2 || list[1].Version != 3 || list[1].Size != 5 {
+		t.Fatal("Wrong versions after restoring:", list)
+	}
+	if _, err = versions.File(channel, "doc.txt", 1); err != errVersionNotFound {
+		t.Fatal("Dropped version must not be found")
+	}
+	v, err := versions.File(channel, "doc.txt", 3)
+	utils.RequirePassCase(t, err, "Fail to read version file")
+	if data, _ := ioutil.ReadFile(v.Path()); string(data) != "three" {
+		t.Fatal("Wrong version content:", string(data))
+	}
+
+	moved := t.TempDir() + fs.Separator + "versions"
+	utils.RequirePassCase(t, versions.moveChannel(channel, moved), "Fail to move channel versions")
+	if list, _ = versions.list(channel, "doc.txt"); len(list) != 0 {
+		t.Fatal("Channel versions not moved")
+	}
+	utils.RequirePassCase(t, versions.restoreChannel(channel, moved), "Fail to restore channel versions")
+	if list, _ = versions.list(channel, "doc.txt"); len(list) != 2 {
+		t.Fatal("Channel versions not restored")
+	}
+}
@@ -0,0 +1,399 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"fs"
+	"fs/hooks"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	webhooksFile           = "webhooks.log"
+	webhookTimeOut         = 10 * time.Second
+	webhookMinBackoff      = time.Second
+	webhookMaxBackoff      = 5 * time.Minute
+	webhookMaxAttempts     = 10
+	webhookMinCompaction   = 100 // Min lines of the queue file to compact it
+	webhookEventHeader     = "X-FS-Event"
+	webhookSignatureHeader = "X-FS-Signature"
+)
+
+type WebhookEventType string
+
+const (
+	EventFileUploaded   WebhookEventType = "FILE_UPLOADED"
+	EventFileDeleted    WebhookEventType = "FILE_DELETED"
+	EventChannelCreated WebhookEventType = "CHANNEL_CREATED"
+	EventChannelDeleted WebhookEventType = "CHANNEL_DELETED"
+)
+
+// WebhookEvent Body of the requests sent to the webhook URLs. The ID is the
+// same for every retry of the event, so receivers can drop duplicates.
+type WebhookEvent struct {
+	ID      string
+	Type    WebhookEventType
+	Time    time.Time
+	CID     uint
+	User    string `json:",omitempty"` // Set instead of the CID, e.g. "admin-api"
+	Channel string
+	File    string `json:",omitempty"`
+	Size    uint64 `json:",omitempty"`
+}
+
+// delivery An event pending to be sent to a URL. Each line of the queue file
+// is the last state of a delivery, and Done is set once it left the queue.
+type delivery struct {
+	Event    WebhookEvent
+	URL      string
+	Attempts int
+	Next     time.Time // When to make the next attempt
+	Done     bool      `json:",omitempty"`
+}
+
+func (d delivery) key() string {
+	return d.Event.ID + " " + d.URL
+}
+
+// webhooks Implements the hooks that POST the file events to the configured
+// URLs. The deliveries are queued into the data root, so they survive restarts,
+// and retried with exponential backoff until they succeed or run out of
+// attempts. Each URL has its own queue and worker, so a receiver that is down
+// doesn't delay the others. Each request body is signed with HMAC-SHA256 of the
+// secret.
+type webhooks struct {
+	hooks.Base
+	mu         sync.Mutex // Guards the queue file
+	journal    *journal
+	compactAt  int
+	targets    []*webhookTarget
+	secret     []byte
+	client     *http.Client
+	minBackoff time.Duration
+	log        logger
+}
+
+// webhookTarget The queue of the deliveries to a URL.
+type webhookTarget struct {
+	url   string
+	mu    sync.Mutex
+	queue []delivery
+	wake  chan struct{}
+}
+
+func loadWebhooks(
+	urls []string,
+	secret string,
+	osDataRoot string,
+	log logger,
+) (*webhooks, error) {
+	w := &webhooks{
+		targets:    make([]*webhookTarget, 0, len(urls)),
+		secret:     []byte(secret),
+		client:     &http.Client{Timeout: webhookTimeOut},
+		minBackoff: webhookMinBackoff,
+		log:        log.with("hooks", "webhooks"),
+	}
+	targets := make(map[string]*webhookTarget)
+	for _, url := range urls {
+		if targets[url] == nil {
+			targets[url] = &webhookTarget{
+				url:   url,
+				queue: make([]delivery, 0),
+				wake:  make(chan struct{}, 1),
+			}
+			w.targets = append(w.targets, targets[url])
+		}
+	}
+	pending := make(map[string]delivery)
+	order := make([]string, 0)
+	j, err := openJournal(osDataRoot+fs.Separator+webhooksFile, func(line []byte) {
+		var d delivery
+		if json.Unmarshal(line, &d) != nil {
+			return // Skip a line that was partially written
+		}
+		if _, ok := pending[d.key()]; !ok {
+			order = append(order, d.key())
+		}
+		pending[d.key()] = d
+	})
+	if err != nil {
+		return nil, err
+	}
+	w.journal = j
+	dropped := 0
+	for _, key := range order {
+		d := pending[key]
+		if d.Done {
+			continue
+		}
+		t, ok := targets[d.URL]
+		if !ok {
+			dropped++
+			continue
+		}
+		t.queue = append(t.queue, d)
+	}
+	if dropped > 0 {
+		w.log.warn("Dropping webhooks of URLs not configured", "deliveries", dropped)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w, w.compact()
+}
+
+// Sends the queued deliveries in the background.
+func (w *webhooks) start() {
+	for _, t := range w.targets {
+		go w.run(t)
+	}
+}
+
+func (w *webhooks) OnUploadCompleted(c hooks.Client, f hooks.File) {
+	w.enqueue(EventFileUploaded, c, f.Channel, f.Path, f.Size)
+}
+
+func (w *webhooks) OnFileDeleted(c hooks.Client, f hooks.File) {
+	w.enqueue(EventFileDeleted, c, f.Channel, f.Path, f.Size)
+}
+
+func (w *webhooks) OnChannelCreated(c hooks.Client, channel string) {
+	w.enqueue(EventChannelCreated, c, channel, "", 0)
+}
+
+func (w *webhooks) OnChannelDeleted(c hooks.Client, channel string) {
+	w.enqueue(EventChannelDeleted, c, channel, "", 0)
+}
+
+func (w *webhooks) enqueue(
+	t WebhookEventType,
+	c hooks.Client,
+	channel string,
+	file string,
+	size uint64,
+) {
+	e := WebhookEvent{
+		ID:      newEventId(),
+		Type:    t,
+		Time:    time.Now(),
+		CID:     c.CID,
+		User:    c.User,
+		Channel: channel,
+		File:    file,
+		Size:    size,
+	}
+	// The lock is held until the deliveries are queued, so their first line is
+	// written before any other line of theirs, and compacting doesn't miss them
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, target := range w.targets {
+		d := delivery{Event: e, URL: target.url, Next: e.Time}
+		w.save(d)
+		target.add(d)
+	}
+}
+
+func (w *webhooks) run(t *webhookTarget) {
+	for {
+		d, wait, ok := t.next()
+		if ok {
+			err := w.send(d)
+			if d, ok = w.done(t, d, err); ok {
+				w.mu.Lock()
+				w.save(d)
+				w.mu.Unlock()
+			}
+			continue
+		}
+		if wait < 0 {
+			<-t.wake
+			continue
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-t.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+func (w *webhooks) send(d delivery) error {
+	body, err := json.Marshal(d.Event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, d.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, string(d.Event.Type))
+	if len(w.secret) > 0 {
+		req.Header.Set(webhookSignatureHeader, "sha256="+signWebhook(w.secret, body))
+	}
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %v", res.StatusCode)
+	}
+	return nil
+}
+
+// Removes the delivery from the queue if it was sent or ran out of attempts,
+// or schedules its next attempt. It returns the new state of the delivery to
+// save.
+func (w *webhooks) done(t *webhookTarget, d delivery, err error) (delivery, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	i := t.indexOf(d)
+	if i == -1 {
+		return d, false
+	}
+	log := w.log.with("event", d.Event.ID, "type", d.Event.Type, "url", d.URL)
+
+	if err == nil {
+		log.debug("Webhook delivered")
+		t.remove(i)
+		d.Done = true
+		return d, true
+	}
+	d = t.queue[i]
+	d.Attempts++
+	if d.Attempts >= webhookMaxAttempts {
+		log.error("Dropping webhook after max attempts", "err", err)
+		t.remove(i)
+		d.Done = true
+		return d, true
+	}
+	backoff := w.backoff(d.Attempts)
+	log.warn("Fail to deliver webhook", "err", err, "attempts", d.Attempts, "retry", backoff)
+	d.Next = time.Now().Add(backoff)
+	t.queue[i] = d
+	return d, true
+}
+
+func (w *webhooks) backoff(attempts int) time.Duration {
+	backoff := w.minBackoff
+	for i := 1; i < attempts && backoff < webhookMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > webhookMaxBackoff {
+		return webhookMaxBackoff
+	}
+	return backoff
+}
+
+// Appends the state of the delivery to the queue file, and compacts it if it
+// has grown enough. It must be called with the lock held.
+func (w *webhooks) save(d delivery) {
+	err := w.journal.write(d)
+	if err == nil && w.journal.lines >= w.compactAt {
+		err = w.compact()
+	}
+	if err != nil {
+		w.log.error("Fail to save webhook queue", "err", err)
+	}
+}
+
+// Rewrites the queue file with the pending deliveries only. It must be called
+// with the lock held.
+func (w *webhooks) compact() error {
+	records := make([]any, 0)
+	for _, t := range w.targets {
+		t.mu.Lock()
+		for _, d := range t.queue {
+			records = append(records, d)
+		}
+		t.mu.Unlock()
+	}
+	w.compactAt = 2 * len(records)
+	if w.compactAt < webhookMinCompaction {
+		w.compactAt = webhookMinCompaction
+	}
+	return w.journal.compact(records)
+}
+
+func (t *webhookTarget) add(d delivery) {
+	t.mu.Lock()
+	t.queue = append(t.queue, d)
+	t.mu.Unlock()
+
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Returns the delivery that is due, or how long to wait for the next one, which
+// is negative if the queue is empty.
+func (t *webhookTarget) next() (delivery, time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.queue) == 0 {
+		return delivery{}, -1, false
+	}
+	first := t.queue[0]
+	for _, d := range t.queue[1:] {
+		if d.Next.Before(first.Next) {
+			first = d
+		}
+	}
+	wait := time.Until(first.Next)
+	if wait > 0 {
+		return delivery{}, wait, false
+	}
+	return first, 0, true
+}
+
+func (t *webhookTarget) indexOf(d delivery) int {
+	for i, q := range t.queue {
+		if q.Event.ID == d.Event.ID {
+			return i
+		}
+	}
+	return -1
+}
+
+func (t *webhookTarget) remove(i int) {
+	t.queue = append(t.queue[:i], t.queue[i+1:]...)
+}
+
+// Returns the hex HMAC-SHA256 of the body, sent as "sha256={signature}".
+func signWebhook(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newEventId() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Returns the list of URLs given comma separated.
+func parseUrls(value string) []string {
+	urls := make([]string, 0)
+	for _, url := range strings.Split(value, ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"encoding/json"
+	"fs"
+	"fs/hooks"
+	"fs/utils"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhooks(t *testing.T) {
+	secret := "secret"
+	received := make(chan WebhookEvent, 1)
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fail the first attempt to test the retry
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get(webhookSignatureHeader) != "sha256="+signWebhook([]byte(secret), body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var e WebhookEvent
+		_ = json.Unmarshal(body, &e)
+		received <- e
+	}))
+	defer server.Close()
+
+	w, err := loadWebhooks([]string{server.URL}, secret, t.TempDir(), logger{})
+	utils.RequirePassCase(t, err, "Fail to load webhooks")
+	w.minBackoff = 10 * time.Millisecond
+	w.start()
+	w.OnUploadCompleted(
+		hooks.Client{CID: 3},
+		hooks.File{Channel: "test", Path: "file.txt", Size: 10},
+	)
+
+	select {
+	case e := <-received:
+		if e.Type != EventFileUploaded || e.File != "file.txt" || e.CID != 3 {
+			t.Fatal("Wrong event received:", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Webhook not delivered")
+	}
+	if atomic.LoadInt32(&calls) != 2 {
+		t.Fatal("Webhook must be retried once")
+	}
+	// Wait for the delivery to leave the queue before the temp dir is removed
+	for _, wait, _ := w.targets[0].next(); wait >= 0; _, wait, _ = w.targets[0].next() {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWebhooksQueue(t *testing.T) {
+	dir := t.TempDir()
+	w, err := loadWebhooks([]string{"http://a", "http://b"}, "", dir, logger{})
+	utils.RequirePassCase(t, err, "Fail to load webhooks")
+	w.OnChannelCreated(hooks.Client{}, "test")
+	w.OnChannelDeleted(hooks.Client{}, "test")
+	d, _, _ := w.targets[0].next()
+	d, _ = w.done(w.targets[0], d, nil)
+	w.save(d)
+
+	// Not started, so the deliveries must be read again after a restart, only
+	// the ones of the URLs still configured
+	w, err = loadWebhooks([]string{"http://a"}, "", dir, logger{})
+	utils.RequirePassCase(t, err, "Fail to reload webhooks")
+	if len(w.targets) != 1 || len(w.targets[0].queue) != 1 ||
+		w.targets[0].queue[0].Event.Type != EventChannelDeleted {
+		t.Fatal("Queue not persisted:", w.targets[0].queue)
+	}
+	data, _ := ioutil.ReadFile(dir + fs.Separator + webhooksFile)
+	if strings.Contains(string(data), "http://b") {
+		t.Fatal("Deliveries of the URLs removed must be dropped")
+	}
+	if w.backoff(1) != webhookMinBackoff || w.backoff(100) != webhookMaxBackoff {
+		t.Fatal("Wrong backoff")
+	}
+}
+
+func TestWebhooksDeadReceiver(t *testing.T) {
+	stalled := make(chan struct{})
+	dead := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		<-stalled
+	}))
+	defer dead.Close()
+	defer close(stalled)
+	received := make(chan struct{}, 2)
+	alive := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		received <- struct{}{}
+	}))
+	defer alive.Close()
+
+	urls := []string{dead.URL, alive.URL}
+	w, err := loadWebhooks(urls, "", t.TempDir(), logger{})
+	utils.RequirePassCase(t, err, "Fail to load webhooks")
+	w.start()
+	w.OnChannelCreated(hooks.Client{}, "test")
+	w.OnChannelDeleted(hooks.Client{}, "test")
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-received:
+		case <-time.After(webhookTimeOut / 2):
+			t.Fatal("Receiver that is down must not delay the others")
+		}
+	}
+}
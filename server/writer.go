@@ -0,0 +1,233 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+)
+
+const outboxSize = 256
+
+var errSlowConsumer = errors.New("slow consumer: too many pending messages")
+
+type pushPriority int
+
+const (
+	priorityLow    pushPriority = iota // Messages that can be dropped, like progress
+	priorityNormal                     // Messages that must be delivered, like updates
+)
+
+type outItem struct {
+	data     []byte
+	priority pushPriority
+	done     chan error // Set for the writes that wait for the result
+}
+
+// outbox Serializes all the writes to the connection of a client into a
+// single writer goroutine.
+//
+// The writes of the client goroutine, like responses and transfer data, block
+// until they are sent and go before anything else. The pushes, like updates
+// and progress events, are queued without blocking the Hub, and they're held
+// while the client has a transfer in progress, so the stream is not corrupted.
+// When the queue is full, the oldest low priority push is dropped, and if there
+// is none, the client is disconnected as a slow consumer. If the pushes are
+// held, they're replaced by an Update with Resync set instead.
+type outbox struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	conn   net.Conn
+	direct []outItem
+	pushes []outItem
+	held   bool
+	err    error // Set when the writer stops
+	size   int
+	log    func() logger
+}
+
+func newOutbox(conn net.Conn, size int, log func() logger) *outbox {
+	o := &outbox{
+		conn:   conn,
+		direct: make([]outItem, 0),
+		pushes: make([]outItem, 0),
+		size:   size,
+		log:    log,
+	}
+	o.cond = sync.NewCond(&o.mu)
+	return o
+}
+
+func (o *outbox) run() {
+	for {
+		item, ok := o.next()
+		if !ok {
+			return
+		}
+		_, err := o.conn.Write(item.data)
+		if item.done != nil {
+			item.done <- err
+		}
+		if err != nil {
+			o.stop(err)
+			return
+		}
+	}
+}
+
+// Waits for the next item to write, or returns false if the writer stopped.
+func (o *outbox) next() (outItem, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for {
+		if o.err != nil {
+			return outItem{}, false
+		}
+		if len(o.direct) > 0 {
+			item := o.direct[0]
+			o.direct = o.direct[1:]
+			return item, true
+		}
+		if !o.held && len(o.pushes) > 0 {
+			return o.popPush(), true
+		}
+		o.cond.Wait()
+	}
+}
+
+// Returns the oldest push of the highest priority. It must be called with the
+// lock held.
+func (o *outbox) popPush() outItem {
+	i := 0
+	for j, item := range o.pushes {
+		if item.priority > o.pushes[i].priority {
+			i = j
+		}
+	}
+	item := o.pushes[i]
+	o.pushes = append(o.pushes[:i], o.pushes[i+1:]...)
+	return item
+}
+
+// Writes the data before any push, and waits until it's sent.
+func (o *outbox) write(p []byte) (int, error) {
+	done := make(chan error, 1)
+	o.mu.Lock()
+	if o.err != nil {
+		o.mu.Unlock()
+		return 0, o.err
+	}
+	o.direct = append(o.direct, outItem{data: p, done: done})
+	o.cond.Signal()
+	o.mu.Unlock()
+
+	if err := <-done; err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Queues the message without waiting for it to be sent.
+func (o *outbox) push(msg Message, priority pushPriority) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.err != nil {
+		return o.err
+	}
+	if len(o.pushes) >= o.size && !o.dropLow() {
+		if !o.held {
+			o.log().warn("Disconnecting slow consumer", "pending", len(o.pushes))
+			o.stopLocked(errSlowConsumer)
+			_ = o.conn.Close()
+			return errSlowConsumer
+		}
+		// Nothing could be sent during the transfer, so the client is not slow.
+		// Replace the pushes with a resync, so it catches up once it ends.
+		o.pushes = append(o.pushes[:0], resyncItem())
+	}
+	item := outItem{data: append(data, '\n'), priority: priority}
+	o.pushes = append(o.pushes, item)
+	o.cond.Signal()
+	return nil
+}
+
+// Returns the push that tells the client the updates held were dropped, so it
+// has to send CATCH_UP.
+func resyncItem() outItem {
+	p, _ := NewPayloadFrom(UpdatePayload{Change: true, Resync: true})
+	data, _ := json.Marshal(Message{Response: Update, Payload: p})
+	return outItem{data: append(data, '\n'), priority: priorityNormal}
+}
+
+// Drops the oldest low priority push, or returns false if there is none.
+func (o *outbox) dropLow() bool {
+	for i, item := range o.pushes {
+		if item.priority == priorityLow {
+			o.pushes = append(o.pushes[:i], o.pushes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Holds the pushes until they're released, e.g. while a transfer is in
+// progress.
+func (o *outbox) hold() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.held = true
+}
+
+func (o *outbox) release() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.held {
+		o.held = false
+		o.cond.Signal()
+	}
+}
+
+func (o *outbox) stop(err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.stopLocked(err)
+}
+
+// Stops the writer and fails the pending writes. It must be called with the
+// lock held.
+func (o *outbox) stopLocked(err error) {
+	if o.err != nil {
+		return
+	}
+	o.err = err
+	for _, item := range o.direct {
+		item.done <- err
+	}
+	o.direct = nil
+	o.pushes = nil
+	o.cond.Broadcast()
+}
+
+// outConn The connection of a client that writes through its outbox, so it can
+// be shared by all the goroutines of the client.
+type outConn struct {
+	net.Conn
+	out *outbox
+}
+
+func (c outConn) Write(p []byte) (int, error) {
+	return c.out.write(p)
+}
+
+func (c outConn) Close() error {
+	c.out.stop(errConnectionClosed)
+	return c.Conn.Close()
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestOutbox(t *testing.T) {
+	conn, client := net.Pipe()
+	defer client.Close()
+	out := newOutbox(conn, 2, func() logger { return logger{} })
+	go out.run()
+	c := outConn{Conn: conn, out: out}
+	defer c.Close()
+	reader := bufio.NewReader(client)
+	read := func() Message {
+		_ = client.SetReadDeadline(time.Now().Add(time.Second))
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			t.Fatal("Fail to read message:", err)
+		}
+		var msg Message
+		_ = json.Unmarshal(line, &msg)
+		return msg
+	}
+
+	// Pushes are held during a transfer, while direct writes go through
+	out.hold()
+	_ = out.push(Message{Response: Update}, priorityNormal)
+	_ = out.push(Message{Response: Progress}, priorityLow)
+	_ = out.push(Message{Response: Progress}, priorityLow) // Drops the oldest progress
+	go func() {
+		_ = writeResponse(Ok, c)
+	}()
+	if read().Response != Ok {
+		t.Fatal("Direct write must not be held")
+	}
+	out.release()
+	if read().Response != Update || read().Response != Progress {
+		t.Fatal("Held pushes must be sent after releasing them, by priority")
+	}
+
+	// The queue is full of pushes that can't be dropped, and the writer is
+	// blocked as the client doesn't read
+	_ = out.push(Message{Response: Update}, priorityNormal)
+	_ = out.push(Message{Response: Update}, priorityNormal)
+	_ = out.push(Message{Response: Update}, priorityNormal)
+	if err := out.push(Message{Response: Update}, priorityNormal); err != errSlowConsumer {
+		t.Fatal("Slow consumer must be disconnected:", err)
+	}
+	if _, err := c.Write([]byte("{}")); err == nil {
+		t.Fatal("Writes must fail after disconnecting")
+	}
+}
+
+func TestOutboxHeldOverflow(t *testing.T) {
+	conn, client := net.Pipe()
+	defer client.Close()
+	out := newOutbox(conn, outboxSize, func() logger { return logger{} })
+	go out.run()
+	defer conn.Close()
+
+	out.hold()
+	for i := 0; i < outboxSize+10; i++ {
+		u, _ := NewPayloadFrom(newChange(ChangeFileAdded, "test", "doc.txt", 10))
+		err := out.push(Message{Response: Update, Payload: u}, priorityNormal)
+		if err != nil {
+			t.Fatal("Client with a transfer in progress must not be disconnected:", err)
+		}
+	}
+	out.release()
+
+	reader := bufio.NewReader(client)
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		t.Fatal("Fail to read message:", err)
+	}
+	var msg Message
+	_ = json.Unmarshal(line, &msg)
+	u, err := msg.UpdatePayload()
+	if err != nil || !u.Resync {
+		t.Fatal("Client must be told to resync the updates dropped:", u)
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	wsPath          = "/ws"
+	wsGuid          = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsMaxPayload    = 1 << 20
+	wsCloseTimeOut  = 2 * time.Second
+	wsOpContinue    = 0x0
+	wsOpText        = 0x1
+	wsOpBinary      = 0x2
+	wsOpClose       = 0x8
+	wsOpPing        = 0x9
+	wsOpPong        = 0xA
+	wsCloseNormal   = 1000
+	wsCloseProtocol = 1002
+	wsCloseTooBig   = 1009
+)
+
+var errWsProtocol = errors.New("websocket protocol error")
+
+// Starts the WebSocket gateway, so browsers can be clients of the server with
+// the same Message protocol of the TCP clients. Only the pages of the same host
+// and of the given origins can connect. It does nothing if the address is
+// empty.
+func serveWebSocket(addr string, origins []string, svc *services, hub *Hub) {
+	if addr == "" {
+		return
+	}
+	log := svc.log.with("gateway", "ws")
+	mux := http.NewServeMux()
+	mux.HandleFunc(wsPath, func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgradeWebSocket(w, r, origins)
+		if err != nil {
+			log.warn("Fail to upgrade connection", "addr", r.RemoteAddr, "err", err)
+			return
+		}
+		accept(conn, svc, hub)
+	})
+	go func() {
+		log.info("Serving WebSocket gateway", "addr", addr, "path", wsPath)
+		err := http.ListenAndServe(addr, mux)
+		log.error("WebSocket gateway stopped", "err", err)
+	}()
+}
+
+// Completes the WebSocket opening handshake and returns the connection.
+func upgradeWebSocket(
+	w http.ResponseWriter,
+	r *http.Request,
+	origins []string,
+) (net.Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" ||
+		key == "" {
+		http.Error(w, "websocket handshake expected", http.StatusBadRequest)
+		return nil, errors.New("invalid websocket handshake")
+	}
+	if !wsOriginAllowed(r, origins) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return nil, errors.New("origin not allowed")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, errors.New("connection can't be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	res := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAcceptKey(key) + "\r\n\r\n"
+	_, err = rw.WriteString(res)
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return newWsConn(conn, rw.Reader), nil
+}
+
+func wsAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + wsGuid))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Returns whether the page of the Origin of the request can connect. Browsers
+// send it, and any page can open a WebSocket, so the ones of other sites are
+// rejected unless they're allowed. Other clients don't send it.
+func wsOriginAllowed(r *http.Request, allowed []string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, o := range allowed {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+func headerContains(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn A server side WebSocket connection read and written as a stream of
+// bytes, so it can be used by a Client as any other net.Conn. Each Write is
+// sent as one binary message, and the payload of the messages received is
+// read in order. Control frames are answered when reading.
+type wsConn struct {
+	net.Conn
+	reader    *bufio.Reader
+	pending   []byte // Rest of the payload of the last frame read
+	writeMu   sync.Mutex
+	closeOnce sync.Once
+}
+
+func newWsConn(conn net.Conn, reader *bufio.Reader) *wsConn {
+	return &wsConn{
+		Conn:   conn,
+		reader: reader,
+	}
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		opcode, payload, err := c.readFrame()
+		if err != nil {
+			return 0, err
+		}
+		switch opcode {
+		case wsOpContinue, wsOpText, wsOpBinary:
+			c.pending = payload
+		case wsOpPing:
+			err = c.writeFrame(wsOpPong, payload)
+			if err != nil {
+				return 0, err
+			}
+		case wsOpClose:
+			c.closeWith(wsCloseNormal)
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	err := c.writeFrame(wsOpBinary, p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) Close() error {
+	c.closeWith(wsCloseNormal)
+	return c.Conn.Close()
+}
+
+// Sends the close frame with the given status code, only once.
+func (c *wsConn) closeWith(code uint16) {
+	c.closeOnce.Do(func() {
+		payload := make([]byte, 2)
+		binary.BigEndian.PutUint16(payload, code)
+		_ = c.Conn.SetWriteDeadline(time.Now().Add(wsCloseTimeOut))
+		_ = c.writeFrame(wsOpClose, payload)
+	})
+}
+
+func (c *wsConn) readFrame() (byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return 0, nil, err
+	}
+	fin := header[0]&0x80 != 0
+	rsv := header[0] & 0x70
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+	control := opcode&0x8 != 0
+
+	// Frames from the client must always be masked, and no extension that
+	// sets the RSV bits was negotiated. Control frames can't be fragmented,
+	// and their payload has at most 125 bytes
+	if !masked || rsv != 0 || control && (!fin || length > 125) {
+		c.closeWith(wsCloseProtocol)
+		return 0, nil, errWsProtocol
+	}
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(c.reader, ext); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(c.reader, ext); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+	if length > wsMaxPayload {
+		c.closeWith(wsCloseTooBig)
+		return 0, nil, errors.New("websocket frame too big")
+	}
+	mask := make([]byte, 4)
+	if _, err := io.ReadFull(c.reader, mask); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	frame := make([]byte, 0, len(payload)+10)
+	frame = append(frame, 0x80|opcode) // FIN
+	length := len(payload)
+
+	switch {
+	case length < 126:
+		frame = append(frame, byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, 126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(length))
+	default:
+		frame = append(frame, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(length))
+	}
+	frame = append(frame, payload...)
+	_, err := c.Conn.Write(frame)
+	return err
+}
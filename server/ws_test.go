@@ -0,0 +1,132 @@
+// Copyright (c) 2022 Tobias Briones. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// This file is part of https://github.com/tobiasbriones/ep-tcp-file-system
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fs/utils"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWsAcceptKey(t *testing.T) {
+	// Example of the RFC 6455
+	if wsAcceptKey("dGhlIHNhbXBsZSBub25jZQ==") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatal("Wrong Sec-WebSocket-Accept key")
+	}
+}
+
+func TestWsConn(t *testing.T) {
+	server, client := net.Pipe()
+	conn := newWsConn(server, bufio.NewReader(server))
+	defer conn.Close()
+	defer client.Close()
+
+	// Two messages are read as one stream of bytes
+	go func() {
+		client.Write(maskedFrame(wsOpText, []byte(`{"Command":`)))
+		client.Write(maskedFrame(wsOpPing, []byte("hi")))
+		client.Write(maskedFrame(wsOpText, []byte(`{"REQ":"CID"}}`)))
+	}()
+	pong := make([]byte, 4)
+	b := make([]byte, 11)
+	_, err := io.ReadFull(conn, b)
+	utils.RequirePassCase(t, err, "Fail to read first message")
+	go io.ReadFull(client, pong)
+	rest := make([]byte, 14)
+	_, err = io.ReadFull(conn, rest)
+	utils.RequirePassCase(t, err, "Fail to read second message")
+	if string(b)+string(rest) != `{"Command":{"REQ":"CID"}}` {
+		t.Fatal("Wrong stream read:", string(b)+string(rest))
+	}
+	if pong[0] != 0x80|wsOpPong || string(pong[2:]) != "hi" {
+		t.Fatal("Ping was not answered with a pong")
+	}
+
+	// Each write is a binary message
+	go conn.Write([]byte("DATA"))
+	frame := make([]byte, 6)
+	_, err = io.ReadFull(client, frame)
+	utils.RequirePassCase(t, err, "Fail to read frame")
+	if frame[0] != 0x80|wsOpBinary || frame[1] != 4 || string(frame[2:]) != "DATA" {
+		t.Fatal("Wrong frame written:", frame)
+	}
+}
+
+func TestWsOriginAllowed(t *testing.T) {
+	cases := []struct {
+		origin  string
+		allowed []string
+		ok      bool
+	}{
+		{"", nil, true},
+		{"http://fs.example.com:8081", nil, true},
+		{"https://evil.example.com", nil, false},
+		{"https://app.example.com", []string{"https://app.example.com"}, true},
+		{"https://evil.example.com", []string{"https://app.example.com"}, false},
+		{"https://evil.example.com", []string{"*"}, true},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "http://fs.example.com:8081"+wsPath, nil)
+		if c.origin != "" {
+			r.Header.Set("Origin", c.origin)
+		}
+		if wsOriginAllowed(r, c.allowed) != c.ok {
+			t.Errorf("Origin %v allowed by %v must be %v", c.origin, c.allowed, c.ok)
+		}
+	}
+}
+
+func TestWsConnProtocolError(t *testing.T) {
+	rsv := maskedFrame(wsOpBinary, []byte("DATA"))
+	rsv[0] |= 0x40
+	fragmentedPing := maskedFrame(wsOpPing, []byte("hi"))
+	fragmentedPing[0] &^= 0x80
+	longPing := maskedFrame(wsOpPing, make([]byte, 126))
+	frames := map[string][]byte{
+		"RSV bits set":              rsv,
+		"control frame without FIN": fragmentedPing,
+		"control frame too long":    longPing,
+	}
+	for name, frame := range frames {
+		server, client := net.Pipe()
+		conn := newWsConn(server, bufio.NewReader(server))
+		go client.Write(frame)
+		closed := make(chan []byte, 1)
+		go func() {
+			b := make([]byte, 4)
+			_, _ = io.ReadFull(client, b)
+			closed <- b
+		}()
+
+		_, err := conn.Read(make([]byte, 4))
+		if err != errWsProtocol {
+			t.Errorf("Frame with %v must be rejected: %v", name, err)
+		}
+		if b := <-closed; b[0] != 0x80|wsOpClose || binary.BigEndian.Uint16(b[2:]) != wsCloseProtocol {
+			t.Errorf("Connection must be closed with a protocol error for %v", name)
+		}
+		server.Close()
+		client.Close()
+	}
+}
+
+func maskedFrame(opcode byte, payload []byte) []byte {
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(payload))}
+	if len(payload) >= 126 {
+		frame = append(frame[:1], 0x80|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}